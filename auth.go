@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	authRouteMetrics = "metrics"
+	authRouteAdmin   = "admin"
+
+	// jwksMinRefresh - Minimal delay between two fetches of key set triggered
+	// by unknown key ids or outdated keys, failed fetches included
+	jwksMinRefresh = time.Minute
+)
+
+type oauth2Config struct {
+	JWKSURL         string                       `yaml:"jwks_url"`
+	CAFile          string                       `yaml:"ca_file"`
+	RefreshInterval time.Duration                `yaml:"jwks_refresh_interval"`
+	Issuer          string                       `yaml:"issuer"`
+	Audience        string                       `yaml:"audience"`
+	Routes          map[string]oauth2RouteConfig `yaml:"routes"`
+}
+
+// oauth2RouteConfig - Token requirements of a group of endpoints, issuer and
+// audience default to the ones of oauth2 section
+type oauth2RouteConfig struct {
+	Issuer   string   `yaml:"issuer"`
+	Audience string   `yaml:"audience"`
+	Scopes   []string `yaml:"scopes"`
+}
+
+func (c *oauth2Config) validate(path string, errs *configErrors) {
+	if len(c.JWKSURL) == 0 {
+		if len(c.Routes) != 0 {
+			errs.add(path+".jwks_url", "missing key, mandatory with routes")
+		}
+		return
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = time.Hour
+	}
+	if c.Routes == nil {
+		c.Routes = map[string]oauth2RouteConfig{}
+	}
+	for name := range c.Routes {
+		if name != authRouteMetrics && name != authRouteAdmin {
+			errs.add(path+".routes", "invalid key '%s', must be metrics or admin", name)
+		}
+	}
+	for _, name := range []string{authRouteMetrics, authRouteAdmin} {
+		r := c.Routes[name]
+		if len(r.Issuer) == 0 {
+			r.Issuer = c.Issuer
+		}
+		if len(r.Audience) == 0 {
+			r.Audience = c.Audience
+		}
+		c.Routes[name] = r
+	}
+}
+
+// scopes - Scope claim, given as list by UAA or space separated string by
+// other authorization servers
+type scopes []string
+
+func (s *scopes) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*s = strings.Fields(value)
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return err
+	}
+	*s = values
+	return nil
+}
+
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Scope scopes `json:"scope"`
+}
+
+// tokenAuth - Validates bearer tokens against keys published on a JWKS URL
+type tokenAuth struct {
+	config    *oauth2Config
+	client    *http.Client
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// attemptedAt - Time of last fetch, successful or not
+	attemptedAt time.Time
+}
+
+// newTokenAuth - Creates token validator, nil when oauth2 is not configured
+func newTokenAuth(config *oauth2Config) (*tokenAuth, error) {
+	if len(config.JWKSURL) == 0 {
+		return nil, nil
+	}
+	tlsCfg, err := (&tlsConfig{CAFile: config.CAFile}).build()
+	if err != nil {
+		return nil, fmt.Errorf("invalid oauth2 tls configuration: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	return &tokenAuth{
+		config: config,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   30 * time.Second,
+		},
+	}, nil
+}
+
+// protect - Wraps handler of given route with token validation, handler is
+// returned as is when oauth2 is not configured
+func (a *tokenAuth) protect(route string, next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	config := a.config.Routes[route]
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || len(raw) == 0 {
+			a.reject(w, route, "missing_token", http.StatusUnauthorized, `Bearer realm="s3rw"`)
+			return
+		}
+
+		opts := []jwt.ParserOption{
+			jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+			jwt.WithExpirationRequired(),
+		}
+		if len(config.Issuer) != 0 {
+			opts = append(opts, jwt.WithIssuer(config.Issuer))
+		}
+		if len(config.Audience) != 0 {
+			opts = append(opts, jwt.WithAudience(config.Audience))
+		}
+		claims := tokenClaims{}
+		if _, err := jwt.ParseWithClaims(raw, &claims, a.key, opts...); err != nil {
+			log.Debugf("rejected token on %s: %s", r.URL.Path, err)
+			a.reject(w, route, "invalid_token", http.StatusUnauthorized, `Bearer realm="s3rw", error="invalid_token"`)
+			return
+		}
+
+		for _, s := range config.Scopes {
+			if !slices.Contains(claims.Scope, s) {
+				log.Debugf("rejected token of '%s' on %s: missing scope '%s'", claims.Subject, r.URL.Path, s)
+				a.reject(w, route, "insufficient_scope", http.StatusForbidden,
+					fmt.Sprintf(`Bearer realm="s3rw", error="insufficient_scope", scope="%s"`, strings.Join(config.Scopes, " ")))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *tokenAuth) reject(w http.ResponseWriter, route string, reason string, code int, challenge string) {
+	authFailures.WithLabelValues(route, reason).Inc()
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, http.StatusText(code), code)
+}
+
+// key - Finds public key matching token key id, key set is fetched again when
+// outdated or when key id is unknown, at most once per jwksMinRefresh whether
+// fetches succeed or not, without blocking other requests during the fetch
+func (a *tokenAuth) key(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	a.mu.Lock()
+	key, ok := a.keys[kid]
+	outdated := time.Since(a.fetchedAt) > a.config.RefreshInterval
+	if ok && !outdated {
+		a.mu.Unlock()
+		return key, nil
+	}
+	if time.Since(a.attemptedAt) < jwksMinRefresh {
+		a.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("unknown key id '%s'", kid)
+	}
+	a.attemptedAt = time.Now()
+	a.mu.Unlock()
+
+	keys, err := a.fetch(context.Background())
+	if err != nil {
+		log.Errorf("unable to refresh oauth2 key set: %s", err)
+		if ok {
+			return key, nil
+		}
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = keys
+	a.fetchedAt = time.Now()
+	if key, ok = a.keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key id '%s'", kid)
+	}
+	return key, nil
+}
+
+// fetch - Reads key set published on JWKS URL, keys of unsupported types
+// are skipped
+func (a *tokenAuth) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.config.JWKSURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status '%s' from '%s'", res.Status, a.config.JWKSURL)
+	}
+
+	set := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("unable to decode key set: %w", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warnf("ignoring oauth2 key '%s': %s", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable key in key set")
+	}
+	log.Debugf("loaded %d oauth2 keys from '%s'", len(keys), a.config.JWKSURL)
+	return keys, nil
+}
+
+// jsonWebKey - Public key of a JWKS document, RFC 7517
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	if len(k.Use) != 0 && k.Use != "sig" {
+		return nil, fmt.Errorf("unsupported use '%s'", k.Use)
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, errors.New("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	connectionCold = "cold"
+	connectionWarm = "warm"
+)
+
+// route - Network path taken by a probe
+type route struct {
+	// Backend is the address connections are forced to, empty for regular
+	// name resolution
+	Backend string
+	// Connection is either cold for a new connection on each request or warm
+	// for pooled keep-alive connections
+	Connection string
+}
+
+// Routes - Network paths to probe during current cycle, one per backend and
+// connection mode
+func (m *Manager) Routes() []route {
+	var res []route
+	backends := m.backends()
+	m.dropTLSStates(backends)
+	for _, b := range backends {
+		for _, c := range m.target.Connections {
+			res = append(res, route{Backend: b, Connection: c})
+		}
+	}
+
+	m.routesMu.Lock()
+	defer m.routesMu.Unlock()
+	for r := range m.routeClients {
+		if !slices.Contains(res, r) {
+			delete(m.routeClients, r)
+		}
+	}
+	return res
+}
+
+// backends - Addresses to probe, backend addresses are resolved again on each
+// call, resolve overrides of the endpoint are used in place of name resolution,
+// empty address stands for regular name resolution
+func (m *Manager) backends() []string {
+	host, port, err := m.endpoint()
+	if err != nil {
+		if m.target.ProbeBackends {
+			m.entry.Errorf("unable to find endpoint host: %s", err)
+		}
+		return []string{""}
+	}
+
+	addrs := m.target.Resolve[net.JoinHostPort(host, port)]
+	if len(addrs) == 0 {
+		if !m.target.ProbeBackends {
+			return []string{""}
+		}
+		resolver := m.target.Resolver.build()
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		ips, err := resolver.LookupIPAddr(context.Background(), host)
+		if err != nil {
+			m.entry.Errorf("unable to resolve backends of '%s': %s", host, err)
+			return []string{""}
+		}
+		for _, ip := range ips {
+			addrs = append(addrs, ip.IP.String())
+		}
+	}
+
+	addrs = slices.Clone(addrs)
+	slices.Sort(addrs)
+	addrs = slices.Compact(addrs)
+	m.entry.Debugf("found %d backends for '%s'", len(addrs), host)
+	return addrs
+}
+
+// endpoint - Host name and port connections are made to, host includes
+// bucket name with virtual-hosted style addressing
+func (m *Manager) endpoint() (string, string, error) {
+	u, err := url.Parse(m.target.URL)
+	if err != nil {
+		return "", "", err
+	}
+	if len(u.Hostname()) == 0 {
+		return "", "", fmt.Errorf("no host in url '%s'", m.target.URL)
+	}
+	port := u.Port()
+	if len(port) == 0 {
+		port = "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+	}
+	if m.target.usePathStyle() {
+		return u.Hostname(), port, nil
+	}
+	return m.target.Bucket + "." + u.Hostname(), port, nil
+}
+
+// transferClient - Transfer client connecting through given route, created on
+// first use
+func (m *Manager) transferClient(r route) (*transfermanager.Client, error) {
+	if len(r.Backend) == 0 && r.Connection != connectionCold {
+		return m.tmClient, nil
+	}
+
+	m.routesMu.Lock()
+	defer m.routesMu.Unlock()
+	if c, ok := m.routeClients[r]; ok {
+		return c, nil
+	}
+
+	httpClient, err := m.newHTTPClient(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transport configuration: %w", err)
+	}
+	// share credentials, region and signing of target client, only the
+	// network path differs
+	client := s3.New(m.client.Options(), func(o *s3.Options) {
+		o.HTTPClient = httpClient
+	})
+	c := m.newTransferClient(client)
+	m.routeClients[r] = c
+	return c, nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	mrand "math/rand/v2"
+	"slices"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	benchPut    = "put"
+	benchGet    = "get"
+	benchHead   = "head"
+	benchList   = "list"
+	benchDelete = "delete"
+)
+
+// benchOperations - Supported operations in report order
+var benchOperations = []string{benchPut, benchGet, benchHead, benchList, benchDelete}
+
+// benchDefaultMix - Relative weights of operations when none is given
+var benchDefaultMix = map[string]int{
+	benchPut:    30,
+	benchGet:    50,
+	benchHead:   10,
+	benchList:   5,
+	benchDelete: 5,
+}
+
+type benchConfig struct {
+	Workers  int
+	Duration time.Duration
+	Sizes    []int64
+	Mix      map[string]int
+	Prefix   string
+}
+
+// benchStats - Measures of an operation
+type benchStats struct {
+	latencies []time.Duration
+	bytes     int64
+	errors    int
+}
+
+// benchRun - Shared state of workers of a benchmark
+type benchRun struct {
+	manager  *Manager
+	client   *s3.Client
+	config   benchConfig
+	payloads [][]byte
+	// total - Sum of operation weights
+	total int
+
+	mu sync.Mutex
+	// keys - Written objects available to operations
+	keys []string
+	// readers - Number of running operations reading each key, keys being
+	// read are not claimed for deletion
+	readers map[string]int
+	// written - Objects written and not deleted yet, removed afterwards
+	written map[string]bool
+	seq     int
+	stats   map[string]*benchStats
+}
+
+// Bench - Runs concurrent workers doing configured mix of operations on
+// objects under prefix until duration is elapsed, written objects are deleted
+// afterwards, other objects under prefix are left untouched
+func (m *Manager) Bench(config benchConfig) (*benchResult, error) {
+	m.mu.RLock()
+	client := m.client
+	m.mu.RUnlock()
+
+	run := &benchRun{
+		manager: m,
+		client:  client,
+		config:  config,
+		readers: map[string]int{},
+		written: map[string]bool{},
+		stats:   map[string]*benchStats{},
+	}
+	for _, op := range benchOperations {
+		if run.total > math.MaxInt-config.Mix[op] {
+			return nil, fmt.Errorf("sum of operation weights is too large")
+		}
+		run.total += config.Mix[op]
+		run.stats[op] = &benchStats{}
+	}
+	if run.total == 0 {
+		return nil, fmt.Errorf("no operation with positive weight")
+	}
+	for _, size := range config.Sizes {
+		payload := make([]byte, size)
+		if _, err := rand.Read(payload); err != nil {
+			return nil, fmt.Errorf("unable to generate payload: %w", err)
+		}
+		run.payloads = append(run.payloads, payload)
+	}
+
+	m.entry.Infof("running benchmark with %d workers for %s under prefix '%s'", config.Workers, config.Duration, config.Prefix)
+	start := time.Now()
+	deadline := start.Add(config.Duration)
+	var wg sync.WaitGroup
+	for range config.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run.work(deadline)
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	cleanupErr := m.deleteKeys(context.Background(), client, slices.Collect(maps.Keys(run.written)))
+	return run.result(elapsed), cleanupErr
+}
+
+// operation - Random operation drawn according to weights of mix
+func (r *benchRun) operation() string {
+	n := mrand.IntN(r.total)
+	for _, op := range benchOperations {
+		if n < r.config.Mix[op] {
+			return op
+		}
+		n -= r.config.Mix[op]
+	}
+	return benchPut
+}
+
+// work - Runs operations until deadline, running operation is completed so
+// that no written object escapes cleanup
+func (r *benchRun) work(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		op := r.operation()
+		var key string
+		if op == benchGet || op == benchHead || op == benchDelete {
+			var ok bool
+			if key, ok = r.pick(op == benchDelete); !ok {
+				op = benchPut
+			}
+		}
+
+		start := time.Now()
+		n, err := r.do(context.Background(), op, key)
+		elapsed := time.Since(start)
+
+		r.mu.Lock()
+		switch {
+		case op == benchGet || op == benchHead:
+			r.readers[key]--
+			if r.readers[key] == 0 {
+				delete(r.readers, key)
+			}
+		case op == benchDelete && err == nil:
+			delete(r.written, key)
+		case op == benchDelete:
+			// object may still exist, give it back to other operations
+			r.keys = append(r.keys, key)
+		}
+		s := r.stats[op]
+		if err != nil {
+			r.manager.entry.Debugf("benchmark %s failed: %s", op, err)
+			s.errors++
+		} else {
+			s.latencies = append(s.latencies, elapsed)
+			s.bytes += n
+		}
+		r.mu.Unlock()
+	}
+}
+
+// pick - Random key among written objects, a key taken for deletion is
+// removed from pool and is never one being read, a key taken for reading is
+// marked as read until operation ends
+func (r *benchRun) pick(remove bool) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	candidates := r.keys
+	if remove {
+		candidates = slices.DeleteFunc(slices.Clone(r.keys), func(k string) bool {
+			return r.readers[k] != 0
+		})
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	key := candidates[mrand.IntN(len(candidates))]
+	if remove {
+		r.keys = slices.DeleteFunc(r.keys, func(k string) bool {
+			return k == key
+		})
+	} else {
+		r.readers[key]++
+	}
+	return key, true
+}
+
+// do - Runs a single operation, returns number of payload bytes transferred
+func (r *benchRun) do(ctx context.Context, op string, key string) (int64, error) {
+	bucket := aws.String(r.manager.target.Bucket)
+	switch op {
+	case benchPut:
+		payload := r.payloads[mrand.IntN(len(r.payloads))]
+		r.mu.Lock()
+		r.seq++
+		key = fmt.Sprintf("%s%08d", r.config.Prefix, r.seq)
+		r.mu.Unlock()
+		_, err := r.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        bucket,
+			Key:           aws.String(key),
+			Body:          bytes.NewReader(payload),
+			ContentLength: aws.Int64(int64(len(payload))),
+		})
+		if err != nil {
+			return 0, err
+		}
+		r.mu.Lock()
+		r.keys = append(r.keys, key)
+		r.written[key] = true
+		r.mu.Unlock()
+		return int64(len(payload)), nil
+	case benchGet:
+		out, err := r.client.GetObject(ctx, &s3.GetObjectInput{Bucket: bucket, Key: aws.String(key)})
+		if err != nil {
+			return 0, err
+		}
+		defer out.Body.Close()
+		return io.Copy(io.Discard, out.Body)
+	case benchHead:
+		_, err := r.client.HeadObject(ctx, &s3.HeadObjectInput{Bucket: bucket, Key: aws.String(key)})
+		return 0, err
+	case benchList:
+		_, err := r.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: bucket, Prefix: aws.String(r.config.Prefix)})
+		return 0, err
+	case benchDelete:
+		_, err := r.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: bucket, Key: aws.String(key)})
+		return 0, err
+	}
+	return 0, fmt.Errorf("unknown operation '%s'", op)
+}
+
+// deleteKeys - Deletes given objects
+func (m *Manager) deleteKeys(ctx context.Context, client *s3.Client, keys []string) error {
+	objects := make([]s3types.ObjectIdentifier, 0, len(keys))
+	for _, k := range keys {
+		objects = append(objects, s3types.ObjectIdentifier{Key: aws.String(k)})
+	}
+	deleted, errs := deleteObjects(ctx, client, m.target.Bucket, objects)
+	m.entry.Infof("deleted %d benchmark objects", deleted)
+	if len(errs) != 0 {
+		return fmt.Errorf("%d benchmark objects left in bucket '%s': %w", len(errs), m.target.Bucket, errs[0])
+	}
+	return nil
+}
+
+// benchResult - Measures of a benchmark per operation
+type benchResult struct {
+	Duration   time.Duration
+	Operations []benchOperationResult
+}
+
+type benchOperationResult struct {
+	Operation  string  `json:"operation"`
+	Count      int     `json:"count"`
+	Errors     int     `json:"errors"`
+	OpsPerSec  float64 `json:"ops_per_second"`
+	Throughput float64 `json:"bytes_per_second"`
+	P50        float64 `json:"latency_p50_seconds"`
+	P90        float64 `json:"latency_p90_seconds"`
+	P99        float64 `json:"latency_p99_seconds"`
+	Max        float64 `json:"latency_max_seconds"`
+}
+
+func (r *benchRun) result(elapsed time.Duration) *benchResult {
+	res := &benchResult{Duration: elapsed}
+	for _, op := range benchOperations {
+		s := r.stats[op]
+		if r.config.Mix[op] == 0 && len(s.latencies) == 0 && s.errors == 0 {
+			continue
+		}
+		slices.Sort(s.latencies)
+		res.Operations = append(res.Operations, benchOperationResult{
+			Operation:  op,
+			Count:      len(s.latencies),
+			Errors:     s.errors,
+			OpsPerSec:  float64(len(s.latencies)) / elapsed.Seconds(),
+			Throughput: float64(s.bytes) / elapsed.Seconds(),
+			P50:        percentile(s.latencies, 0.50).Seconds(),
+			P90:        percentile(s.latencies, 0.90).Seconds(),
+			P99:        percentile(s.latencies, 0.99).Seconds(),
+			Max:        percentile(s.latencies, 1).Seconds(),
+		})
+	}
+	return res
+}
+
+// percentile - Nearest-rank percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p+0.5) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// printTable - Writes results as aligned text table
+func (r *benchResult) printTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "operation\tcount\terrors\tops/s\tMiB/s\tp50\tp90\tp99\tmax\t")
+	seconds := func(v float64) string {
+		return time.Duration(v * float64(time.Second)).Round(time.Microsecond).String()
+	}
+	for _, o := range r.Operations {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%.2f\t%s\t%s\t%s\t%s\t\n",
+			o.Operation, o.Count, o.Errors, o.OpsPerSec, o.Throughput/(1<<20),
+			seconds(o.P50), seconds(o.P90), seconds(o.P99), seconds(o.Max))
+	}
+	fmt.Fprintf(tw, "duration: %s\n", r.Duration.Round(time.Millisecond))
+	return tw.Flush()
+}
+
+func (r *benchResult) printJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Duration   float64                `json:"duration_seconds"`
+		Operations []benchOperationResult `json:"operations"`
+	}{r.Duration.Seconds(), r.Operations})
+}
+
+func (r *benchResult) printCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{
+		"operation", "count", "errors", "ops_per_second", "bytes_per_second",
+		"latency_p50_seconds", "latency_p90_seconds", "latency_p99_seconds", "latency_max_seconds",
+	})
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	for _, o := range r.Operations {
+		cw.Write([]string{
+			o.Operation, strconv.Itoa(o.Count), strconv.Itoa(o.Errors), format(o.OpsPerSec), format(o.Throughput),
+			format(o.P50), format(o.P90), format(o.P99), format(o.Max),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
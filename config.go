@@ -1,14 +1,15 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"os"
+	"net"
+	"slices"
+	"strings"
 	"time"
 
-	log "github.com/sirupsen/logrus"
-
+	"github.com/prometheus/exporter-toolkit/web"
 	"gopkg.in/yaml.v2"
 )
 
@@ -22,18 +23,55 @@ type exporterConfig struct {
 	Port             int           `yaml:"port"`
 	Path             string        `yaml:"path"`
 	Namespace        string        `yaml:"namespace"`
+	SecretsRefresh   time.Duration `yaml:"secrets_refresh_interval"`
+	WebConfigFile    string        `yaml:"web_config_file"`
+	OAuth2           oauth2Config  `yaml:"oauth2"`
+	ConfigWatch      time.Duration `yaml:"config_watch_interval"`
+	InstanceID       string        `yaml:"instance_id"`
 }
 
 type s3Config struct {
-	URL              string `yaml:"url"`
-	Region           string `yaml:"region"`
-	Bucket           string `yaml:"bucket"`
-	DownloadKey      string `yaml:"download_file_name"`
-	DownloadFilePath string `yaml:"download_file_path"`
-	UploadKey        string `yaml:"upload_file_name"`
-	UploadFilePath   string `yaml:"upload_file_path"`
-	APIKey           string `yaml:"api_key"`
-	APISecret        string `yaml:"secret_access_key"`
+	Name             string              `yaml:"name"`
+	URL              string              `yaml:"url"`
+	Region           string              `yaml:"region"`
+	Bucket           string              `yaml:"bucket"`
+	DownloadKey      string              `yaml:"download_file_name"`
+	DownloadFilePath string              `yaml:"download_file_path"`
+	UploadKey        string              `yaml:"upload_file_name"`
+	UploadFilePath   string              `yaml:"upload_file_path"`
+	APIKey           secret              `yaml:"api_key"`
+	APISecret        secret              `yaml:"secret_access_key"`
+	Credentials      credentialsConfig   `yaml:"credentials"`
+	AddressingStyle  string              `yaml:"addressing_style"`
+	DualStack        bool                `yaml:"dual_stack"`
+	FIPS             bool                `yaml:"fips"`
+	Signing          string              `yaml:"signing"`
+	TLS              tlsConfig           `yaml:"tls"`
+	ProxyURL         secret              `yaml:"proxy_url"`
+	SourceAddress    string              `yaml:"source_address"`
+	Resolver         resolverConfig      `yaml:"resolver"`
+	ProbeBackends    bool                `yaml:"probe_backends"`
+	Resolve          map[string][]string `yaml:"resolve"`
+	Connections      []string            `yaml:"connections"`
+	Exposure         exposureConfig      `yaml:"exposure"`
+	BucketSettings   bucketSettings      `yaml:"bucket_settings"`
+	SelfRepair       selfRepairConfig    `yaml:"self_repair"`
+	StaleKeyMaxAge   time.Duration       `yaml:"stale_key_max_age"`
+	Janitor          janitorConfig       `yaml:"janitor"`
+
+	// path - Location of target in configuration, used in error messages
+	path string
+}
+
+type exposureConfig struct {
+	Enabled bool            `yaml:"enabled"`
+	Key     string          `yaml:"key"`
+	Buckets []watchedBucket `yaml:"buckets"`
+}
+
+type watchedBucket struct {
+	Name string `yaml:"name"`
+	Key  string `yaml:"key"`
 }
 
 // Config -
@@ -41,81 +79,308 @@ type Config struct {
 	Log      logConfig      `yaml:"log"`
 	Exporter exporterConfig `yaml:"exporter"`
 	S3       s3Config       `yaml:"s3"`
+	Targets  []s3Config     `yaml:"targets"`
+	VCAP     vcapConfig     `yaml:"vcap"`
+}
+
+// configErrors - Problems found in configuration, each one prefixed with the
+// YAML path of the key at fault
+type configErrors []string
+
+func (e *configErrors) add(path string, format string, args ...any) {
+	*e = append(*e, path+": "+fmt.Sprintf(format, args...))
 }
 
-func (c *exporterConfig) validate() error {
+func (e configErrors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// err - Nil when no problem was found
+func (e configErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (c *exporterConfig) validate(path string, errs *configErrors) {
 	if len(c.Path) == 0 {
-		return fmt.Errorf("missing key 'exporter.path'")
+		errs.add(path+".path", "missing mandatory key")
 	}
 	if c.Port == 0 {
-		return fmt.Errorf("missing or zero key 'expoerter.port'")
+		errs.add(path+".port", "missing or zero key")
 	}
 	if c.IntervalDuration == 0 {
-		return fmt.Errorf("missing or zero key 'exporter.interval_duration'")
+		errs.add(path+".interval_duration", "missing or zero key")
 	}
-	return nil
+	if c.SecretsRefresh == 0 {
+		c.SecretsRefresh = 30 * time.Second
+	}
+	if len(c.WebConfigFile) != 0 {
+		if err := web.Validate(c.WebConfigFile); err != nil {
+			errs.add(path+".web_config_file", "invalid web configuration: %s", err)
+		}
+	}
+	c.OAuth2.validate(path+".oauth2", errs)
 }
 
-func (c *s3Config) validate() error {
-	if len(c.URL) == 0 {
-		return fmt.Errorf("missing mandatory key s3.url")
-	}
+// secrets - Sensitive values of target that may reference external sources
+func (c *s3Config) secrets() []secret {
+	return append(c.Credentials.secrets(), c.APIKey, c.APISecret, c.ProxyURL)
+}
+
+func (c *s3Config) validate(path string, errs *configErrors) {
 	if len(c.Bucket) == 0 {
-		return fmt.Errorf("missing mandatory key s3.bucket")
+		errs.add(path+".bucket", "missing mandatory key")
 	}
-	if len(c.Region) == 0 {
-		return fmt.Errorf("missing mandatory key s3.region")
+	switch c.AddressingStyle {
+	case "":
+		c.AddressingStyle = addressingAuto
+	case addressingAuto, addressingPath, addressingVirtual:
+	default:
+		errs.add(path+".addressing_style", "invalid value '%s', must be one of auto, path, virtual", c.AddressingStyle)
 	}
 	if len(c.DownloadKey) == 0 {
-		return fmt.Errorf("missing mandatory key s3.download_key")
+		errs.add(path+".download_file_name", "missing mandatory key")
+	} else {
+		validateKeyTemplate(path+".download_file_name", c.DownloadKey, true, errs)
 	}
 	if len(c.DownloadFilePath) == 0 {
-		return fmt.Errorf("missing mandatory key s3.download_file_path")
+		errs.add(path+".download_file_path", "missing mandatory key")
 	}
 	if len(c.UploadKey) == 0 {
-		return fmt.Errorf("missing mandatory key s3.upload_key")
+		errs.add(path+".upload_file_name", "missing mandatory key")
+	} else {
+		validateKeyTemplate(path+".upload_file_name", c.UploadKey, false, errs)
 	}
 	if len(c.UploadFilePath) == 0 {
-		return fmt.Errorf("missing mandatory key s3.upload_file_path")
+		errs.add(path+".upload_file_path", "missing mandatory key")
+	}
+	if len(c.Credentials.Type) == 0 {
+		// legacy api_key and secret_access_key are static credentials
+		if len(c.APIKey) == 0 {
+			errs.add(path+".api_key", "missing mandatory key")
+		}
+		if len(c.APISecret) == 0 {
+			errs.add(path+".secret_access_key", "missing mandatory key")
+		}
+		c.Credentials.Type = credentialsStatic
+		c.Credentials.AccessKeyID = c.APIKey
+		c.Credentials.SecretAccessKey = c.APISecret
+	} else {
+		c.Credentials.validate(path+".credentials", errs)
+	}
+	switch c.Signing {
+	case "":
+		c.Signing = signingV4
+	case signingV4, signingV4SignedPayload, signingV4Unchunked, signingV2:
+	default:
+		errs.add(path+".signing", "invalid value '%s', must be one of v4, v4-signed-payload, v4-unchunked, v2", c.Signing)
+	}
+	// canonicalized resource of v2 signatures is computed from request path
+	if c.Signing == signingV2 && c.AddressingStyle == addressingVirtual {
+		errs.add(path+".addressing_style", "virtual cannot be used with signing v2")
+	}
+	c.TLS.validate(path+".tls", errs)
+	if len(c.SourceAddress) != 0 && net.ParseIP(c.SourceAddress) == nil {
+		errs.add(path+".source_address", "invalid address '%s'", c.SourceAddress)
 	}
-	if len(c.APIKey) == 0 {
-		return fmt.Errorf("missing mandatory key s3.api_key")
+	c.Resolver.validate(path+".resolver", errs)
+	for hostport, addrs := range c.Resolve {
+		if _, _, err := net.SplitHostPort(hostport); err != nil {
+			errs.add(path+".resolve", "invalid key '%s', must be host:port", hostport)
+		}
+		for _, a := range addrs {
+			if net.ParseIP(a) == nil {
+				errs.add(path+".resolve."+hostport, "invalid address '%s'", a)
+			}
+		}
+	}
+	if len(c.Connections) == 0 {
+		c.Connections = []string{connectionWarm}
+	}
+	for i, conn := range c.Connections {
+		if conn != connectionCold && conn != connectionWarm {
+			errs.add(fmt.Sprintf("%s.connections[%d]", path, i), "invalid value '%s', must be cold or warm", conn)
+		}
 	}
-	if len(c.APISecret) == 0 {
-		return fmt.Errorf("missing mandatory key s3.api_secret")
+	if c.ProbeBackends && len(c.URL) == 0 {
+		errs.add(path+".url", "missing key, mandatory with probe_backends")
+	}
+	if c.ProbeBackends && len(c.ProxyURL) != 0 {
+		errs.add(path+".probe_backends", "cannot be used with proxy_url")
+	}
+	if len(c.Resolve) != 0 && len(c.ProxyURL) != 0 {
+		errs.add(path+".resolve", "cannot be used with proxy_url")
+	}
+	c.Exposure.validate(path+".exposure", errs)
+	c.BucketSettings.validate(path+".bucket_settings", errs)
+	c.Janitor.validate(path+".janitor", errs)
+}
+
+func (c *exposureConfig) validate(path string, errs *configErrors) {
+	if !c.Enabled {
+		return
+	}
+	if len(c.Key) == 0 {
+		c.Key = "s3rw-exposure-check"
+	}
+	validateKeyTemplate(path+".key", c.Key, false, errs)
+	for i, b := range c.Buckets {
+		if len(b.Name) == 0 {
+			errs.add(fmt.Sprintf("%s.buckets[%d].name", path, i), "missing mandatory key")
+		}
+	}
+}
+
+// loadTargets - Gathers targets from legacy s3 key and VCAP_SERVICES bindings
+func (c *Config) loadTargets() error {
+	for i := range c.Targets {
+		c.Targets[i].path = fmt.Sprintf("targets[%d]", i)
+	}
+	if len(c.S3.URL) != 0 || len(c.S3.Bucket) != 0 {
+		if len(c.S3.Name) == 0 {
+			c.S3.Name = "default"
+		}
+		c.S3.path = "s3"
+		c.Targets = append([]s3Config{c.S3}, c.Targets...)
+	}
+	if !c.VCAP.Enabled {
+		return nil
+	}
+	bindings, err := c.VCAP.targets()
+	if err != nil {
+		return err
+	}
+	for _, b := range bindings {
+		idx := slices.IndexFunc(c.Targets, func(t s3Config) bool {
+			return t.Name == b.Name
+		})
+		if idx == -1 {
+			b.path = "VCAP_SERVICES[" + b.Name + "]"
+			c.Targets = append(c.Targets, b)
+			continue
+		}
+		c.Targets[idx].merge(b)
 	}
 	return nil
 }
 
-// Validate - Validate configuration object
+// Validate - Validate configuration object, all problems found are reported
 func (c *Config) Validate() error {
-	if err := c.S3.validate(); err != nil {
-		return fmt.Errorf("invalid s3 configuration: %s", err)
+	errs := configErrors{}
+	if len(c.Targets) == 0 {
+		errs.add("targets", "no target configured, missing key 's3' or 'targets'")
 	}
-	if err := c.Exporter.validate(); err != nil {
-		return fmt.Errorf("invalid exporter configuration: %s", err)
+	names := map[string]bool{}
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		if len(t.Name) == 0 {
+			errs.add(t.path+".name", "missing mandatory key")
+		} else if names[t.Name] {
+			errs.add(t.path+".name", "duplicate target name '%s'", t.Name)
+		}
+		names[t.Name] = true
+		t.validate(t.path, &errs)
 	}
-	return nil
+	c.Exporter.validate("exporter", &errs)
+	return errs.err()
 }
 
-// NewConfig - Creates and validates config from given reader
-func NewConfig(file io.Reader) *Config {
+// NewConfig - Creates and validates config from given reader, format is
+// detected from file extension when reader is a file, from content otherwise
+func NewConfig(file io.Reader) (*Config, error) {
 	content, err := io.ReadAll(file)
 	if err != nil {
-		log.Fatalf("unable to read configuration file : %s", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("unable to read configuration file: %s", err)
 	}
+	name := ""
+	if f, ok := file.(interface{ Name() string }); ok {
+		name = f.Name()
+	}
+	format := configFormat(name, content)
+
+	// problems of every stage are reported at once, validation is skipped
+	// only when content could not be decoded at all
+	errs := configErrors{}
+	content = expandEnv(content, format, &errs)
 	config := Config{}
-	if err = yaml.Unmarshal(content, &config); err != nil {
-		log.Fatalf("unable to read configuration yaml file: %s", err)
-		if err = json.Unmarshal(content, &config); err != nil {
-			log.Fatalf("unable to read configuration json file: %s", err)
-			os.Exit(1)
+	if decodeConfig(content, format, &config, &errs) {
+		if err := config.loadTargets(); err != nil {
+			errs.add("vcap", "unable to load targets: %s", err)
 		}
+		var validationErrs configErrors
+		if errors.As(config.Validate(), &validationErrs) {
+			errs = append(errs, validationErrs...)
+		}
+	}
+	if err := errs.err(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
 	}
-	if err = config.Validate(); err != nil {
-		log.Fatalf("invalid configuration, %s", err)
-		os.Exit(1)
+	return &config, nil
+}
+
+// Print - Writes normalized configuration with secrets masked, legacy s3 key
+// appears among targets and unset keys are omitted
+func (c *Config) Print(w io.Writer) error {
+	content, err := yaml.Marshal(struct {
+		Log      logConfig      `yaml:"log"`
+		Exporter exporterConfig `yaml:"exporter"`
+		Targets  []s3Config     `yaml:"targets"`
+		VCAP     vcapConfig     `yaml:"vcap"`
+	}{c.Log, c.Exporter, c.Targets, c.VCAP})
+	if err != nil {
+		return fmt.Errorf("unable to encode configuration: %s", err)
+	}
+	tree := yaml.MapSlice{}
+	if err := yaml.Unmarshal(content, &tree); err != nil {
+		return fmt.Errorf("unable to encode configuration: %s", err)
+	}
+	if content, err = yaml.Marshal(pruneEmpty(tree)); err != nil {
+		return fmt.Errorf("unable to encode configuration: %s", err)
+	}
+	_, err = w.Write(content)
+	return err
+}
+
+// pruneEmpty - Removes keys with empty values from decoded YAML tree, nil
+// when nothing is left
+func pruneEmpty(value any) any {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		res := yaml.MapSlice{}
+		for _, item := range v {
+			if pruned := pruneEmpty(item.Value); pruned != nil {
+				res = append(res, yaml.MapItem{Key: item.Key, Value: pruned})
+			}
+		}
+		if len(res) == 0 {
+			return nil
+		}
+		return res
+	case []any:
+		if len(v) == 0 {
+			return nil
+		}
+		res := make([]any, 0, len(v))
+		for _, item := range v {
+			if pruned := pruneEmpty(item); pruned != nil {
+				res = append(res, pruned)
+			}
+		}
+		return res
+	case string:
+		if len(v) == 0 || v == "0s" {
+			return nil
+		}
+	case bool:
+		if !v {
+			return nil
+		}
+	case int:
+		if v == 0 {
+			return nil
+		}
 	}
-	return &config
+	return value
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	formatYAML = "yaml"
+	formatJSON = "json"
+)
+
+var (
+	// envPattern - Matches ${VAR} and ${VAR:-default} references
+	envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+	// unknownFieldPattern - Matches unknown key errors of strict YAML decoder
+	unknownFieldPattern = regexp.MustCompile(`field (\S+) not found in type \S+`)
+)
+
+// configFormat - Detects configuration format from file extension, or from
+// content when extension is unknown
+func configFormat(name string, content []byte) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return formatJSON
+	case ".yml", ".yaml":
+		return formatYAML
+	}
+	if trimmed := bytes.TrimSpace(content); len(trimmed) != 0 && trimmed[0] == '{' {
+		return formatJSON
+	}
+	return formatYAML
+}
+
+// expandEnv - Replaces ${VAR} and ${VAR:-default} references with environment
+// values, references to unset variables without default are reported and
+// left as is, YAML comment lines are left untouched
+func expandEnv(content []byte, format string, errs *configErrors) []byte {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	for i, line := range lines {
+		if format == formatYAML && bytes.HasPrefix(bytes.TrimSpace(line), []byte("#")) {
+			continue
+		}
+		lines[i] = envPattern.ReplaceAllFunc(line, func(ref []byte) []byte {
+			match := envPattern.FindSubmatch(ref)
+			if value, ok := os.LookupEnv(string(match[1])); ok {
+				return []byte(value)
+			}
+			if len(match[2]) != 0 {
+				return match[3]
+			}
+			errs.add(fmt.Sprintf("line %d", i+1), "environment variable '%s' is not set", match[1])
+			return ref
+		})
+	}
+	return bytes.Join(lines, nil)
+}
+
+// decodeConfig - Decodes configuration rejecting unknown keys, JSON is
+// decoded as the YAML subset it is once checked as valid, returns false when
+// content could not be decoded at all
+func decodeConfig(content []byte, format string, config *Config, errs *configErrors) bool {
+	if format == formatJSON && !json.Valid(content) {
+		var value any
+		err := json.Unmarshal(content, &value)
+		var syntaxErr *json.SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			errs.add("configuration", "%s", err)
+			return false
+		}
+		line := bytes.Count(content[:syntaxErr.Offset], []byte("\n")) + 1
+		errs.add(fmt.Sprintf("line %d", line), "%s", err)
+		return false
+	}
+	err := yaml.UnmarshalStrict(content, config)
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		if err != nil {
+			errs.add("configuration", "%s", err)
+			return false
+		}
+		return true
+	}
+	unknown := false
+	for _, e := range typeErr.Errors {
+		// strict decoder only locates unknown keys by line
+		if unknownFieldPattern.MatchString(e) {
+			unknown = true
+			continue
+		}
+		location, msg, ok := strings.Cut(e, ": ")
+		if !ok {
+			location, msg = "configuration", e
+		}
+		errs.add(location, "%s", msg)
+	}
+	if unknown {
+		var document yaml.MapSlice
+		if err := yaml.Unmarshal(content, &document); err != nil {
+			errs.add("configuration", "%s", err)
+		} else {
+			unknownKeys("", document, reflect.TypeOf(*config), errs)
+		}
+	}
+	return true
+}
+
+// unknownKeys - Reports keys of decoded value matching no field of given type,
+// with their YAML path
+func unknownKeys(path string, value any, typ reflect.Type, errs *configErrors) {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	join := func(key any) string {
+		if len(path) == 0 {
+			return fmt.Sprint(key)
+		}
+		return fmt.Sprintf("%s.%v", path, key)
+	}
+	switch typ.Kind() {
+	case reflect.Struct:
+		items, ok := value.(yaml.MapSlice)
+		if !ok {
+			return
+		}
+		fields := map[string]reflect.Type{}
+		for i := range typ.NumField() {
+			f := typ.Field(i)
+			if !f.IsExported() {
+				continue
+			}
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if len(name) == 0 {
+				name = strings.ToLower(f.Name)
+			}
+			if name != "-" {
+				fields[name] = f.Type
+			}
+		}
+		for _, item := range items {
+			field, ok := fields[fmt.Sprint(item.Key)]
+			if !ok {
+				errs.add(join(item.Key), "unknown key '%v'", item.Key)
+				continue
+			}
+			unknownKeys(join(item.Key), item.Value, field, errs)
+		}
+	case reflect.Map:
+		items, ok := value.(yaml.MapSlice)
+		if !ok {
+			return
+		}
+		for _, item := range items {
+			unknownKeys(join(item.Key), item.Value, typ.Elem(), errs)
+		}
+	case reflect.Slice:
+		items, ok := value.([]any)
+		if !ok {
+			return
+		}
+		for i, item := range items {
+			unknownKeys(fmt.Sprintf("%s[%d]", path, i), item, typ.Elem(), errs)
+		}
+	}
+}
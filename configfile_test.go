@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfigFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    string
+	}{
+		{name: "json extension", file: "config.json", content: "a: 1", want: formatJSON},
+		{name: "yaml extension", file: "config.YML", content: "{}", want: formatYAML},
+		{name: "json content", file: "config", content: "\n  {\"a\": 1}", want: formatJSON},
+		{name: "yaml content", file: "", content: "a: 1", want: formatYAML},
+		{name: "empty", file: "", content: "", want: formatYAML},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := configFormat(tt.file, []byte(tt.content)); got != tt.want {
+				t.Errorf("configFormat = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("S3RW_TEST_SET", "value")
+	t.Setenv("S3RW_TEST_EMPTY", "")
+
+	tests := []struct {
+		name    string
+		content string
+		format  string
+		want    string
+		errs    []string
+	}{
+		{name: "set", content: "a: ${S3RW_TEST_SET}\n", want: "a: value\n"},
+		{name: "set over default", content: "a: ${S3RW_TEST_SET:-other}", want: "a: value"},
+		{name: "empty value kept", content: "a: '${S3RW_TEST_EMPTY:-other}'", want: "a: ''"},
+		{name: "default", content: "a: ${S3RW_TEST_UNSET:-other}", want: "a: other"},
+		{name: "empty default", content: "a: '${S3RW_TEST_UNSET:-}'", want: "a: ''"},
+		{name: "several on a line", content: "a: ${S3RW_TEST_SET}-${S3RW_TEST_UNSET:-x}", want: "a: value-x"},
+		{name: "not a reference", content: "a: $S3RW_TEST_SET ${1A}", want: "a: $S3RW_TEST_SET ${1A}"},
+		{
+			name:    "unset",
+			content: "a: 1\nb: ${S3RW_TEST_UNSET}\nc: ${S3RW_TEST_UNSET2}\n",
+			want:    "a: 1\nb: ${S3RW_TEST_UNSET}\nc: ${S3RW_TEST_UNSET2}\n",
+			errs: []string{
+				"line 2: environment variable 'S3RW_TEST_UNSET' is not set",
+				"line 3: environment variable 'S3RW_TEST_UNSET2' is not set",
+			},
+		},
+		{name: "yaml comment", content: "  # ${S3RW_TEST_UNSET}\na: 1", want: "  # ${S3RW_TEST_UNSET}\na: 1"},
+		{
+			name:    "json has no comment",
+			content: "{\"a\": \"# ${S3RW_TEST_SET}\"}",
+			format:  formatJSON,
+			want:    "{\"a\": \"# value\"}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := tt.format
+			if len(format) == 0 {
+				format = formatYAML
+			}
+			errs := configErrors{}
+			got := string(expandEnv([]byte(tt.content), format, &errs))
+			if got != tt.want {
+				t.Errorf("expandEnv = %q, want %q", got, tt.want)
+			}
+			if strings.Join(errs, "\n") != strings.Join(tt.errs, "\n") {
+				t.Errorf("errors = %q, want %q", errs, tt.errs)
+			}
+		})
+	}
+}
+
+func TestDecodeConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		format  string
+		decoded bool
+		errs    []string
+	}{
+		{
+			name:    "valid",
+			content: "exporter:\n  port: 1\ntargets:\n  - name: a\n",
+			decoded: true,
+		},
+		{
+			name:    "unknown keys by path",
+			content: "exporter:\n  bogus: 1\ntargets:\n  - name: a\n    tls:\n      cafile: x\n  - name: b\n    weird: true\nextra: 1\n",
+			decoded: true,
+			errs: []string{
+				"exporter.bogus: unknown key 'bogus'",
+				"targets[0].tls.cafile: unknown key 'cafile'",
+				"targets[1].weird: unknown key 'weird'",
+				"extra: unknown key 'extra'",
+			},
+		},
+		{
+			name:    "map values walked",
+			content: "exporter:\n  oauth2:\n    routes:\n      admin:\n        scope: [a]\n",
+			decoded: true,
+			errs:    []string{"exporter.oauth2.routes.admin.scope: unknown key 'scope'"},
+		},
+		{
+			name:    "legacy target and vcap defaults",
+			content: "s3:\n  bogus: 1\nvcap:\n  defaults:\n    nope: 2\n",
+			decoded: true,
+			errs: []string{
+				"s3.bogus: unknown key 'bogus'",
+				"vcap.defaults.nope: unknown key 'nope'",
+			},
+		},
+		{
+			name:    "type error keeps line",
+			content: "exporter:\n  port: abc\n",
+			decoded: true,
+			errs:    []string{"line 2: cannot unmarshal !!str `abc` into int"},
+		},
+		{
+			name:    "yaml syntax",
+			content: "a: [\n",
+			errs:    []string{"configuration: yaml: line 1: did not find expected node content"},
+		},
+		{
+			name:    "json unknown key",
+			content: "{\"exporter\": {\"bogus\": 1}}",
+			format:  formatJSON,
+			decoded: true,
+			errs:    []string{"exporter.bogus: unknown key 'bogus'"},
+		},
+		{
+			name:    "json syntax",
+			content: "{\n\"exporter\": {\n\"port\": 1,\n}}",
+			format:  formatJSON,
+			errs:    []string{"line 4: invalid character '}' looking for beginning of object key string"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format := tt.format
+			if len(format) == 0 {
+				format = formatYAML
+			}
+			errs := configErrors{}
+			config := Config{}
+			if decoded := decodeConfig([]byte(tt.content), format, &config, &errs); decoded != tt.decoded {
+				t.Errorf("decoded = %v, want %v", decoded, tt.decoded)
+			}
+			if strings.Join(errs, "\n") != strings.Join(tt.errs, "\n") {
+				t.Errorf("errors\n%s\nwant\n%s", strings.Join(errs, "\n"), strings.Join(tt.errs, "\n"))
+			}
+		})
+	}
+}
+
+func TestNewConfigReportsEveryStage(t *testing.T) {
+	content := "exporter:\n  port: ${S3RW_TEST_UNSET}\n  bogus: 1\ntargets:\n  - name: a\n"
+	_, err := NewConfig(strings.NewReader(content))
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{
+		"line 2: environment variable 'S3RW_TEST_UNSET' is not set",
+		"exporter.bogus: unknown key 'bogus'",
+		"targets[0].bucket: missing mandatory key",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const (
+	credentialsStatic      = "static"
+	credentialsProfile     = "profile"
+	credentialsDefault     = "default"
+	credentialsAssumeRole  = "assume_role"
+	credentialsWebIdentity = "web_identity"
+)
+
+type credentialsConfig struct {
+	Type                 string        `yaml:"type"`
+	AccessKeyID          secret        `yaml:"access_key_id"`
+	SecretAccessKey      secret        `yaml:"secret_access_key"`
+	SessionToken         secret        `yaml:"session_token"`
+	Profile              string        `yaml:"profile"`
+	RoleARN              string        `yaml:"role_arn"`
+	ExternalID           secret        `yaml:"external_id"`
+	SessionName          string        `yaml:"session_name"`
+	Duration             time.Duration `yaml:"duration"`
+	WebIdentityTokenFile string        `yaml:"web_identity_token_file"`
+	STSURL               string        `yaml:"sts_url"`
+	Credhub              credhubConfig `yaml:"credhub"`
+}
+
+func (c *credentialsConfig) validate(path string, errs *configErrors) {
+	switch c.Type {
+	case credentialsStatic:
+		if len(c.AccessKeyID) == 0 {
+			errs.add(path+".access_key_id", "missing mandatory key")
+		}
+		if len(c.SecretAccessKey) == 0 {
+			errs.add(path+".secret_access_key", "missing mandatory key")
+		}
+	case credentialsProfile:
+		if len(c.Profile) == 0 {
+			errs.add(path+".profile", "missing mandatory key")
+		}
+	case credentialsDefault:
+	case credentialsAssumeRole:
+		if len(c.RoleARN) == 0 {
+			errs.add(path+".role_arn", "missing mandatory key")
+		}
+	case credentialsWebIdentity:
+		if len(c.RoleARN) == 0 {
+			errs.add(path+".role_arn", "missing mandatory key")
+		}
+		if len(c.WebIdentityTokenFile) == 0 {
+			errs.add(path+".web_identity_token_file", "missing mandatory key")
+		}
+	case credentialsCredhub:
+		c.Credhub.validate(path+".credhub", errs)
+	default:
+		errs.add(path+".type", "invalid value '%s'", c.Type)
+	}
+	if len(c.SessionName) == 0 {
+		c.SessionName = "s3rw-exporter"
+	}
+}
+
+// secrets - Sensitive values that may reference external sources
+func (c *credentialsConfig) secrets() []secret {
+	return []secret{c.AccessKeyID, c.SecretAccessKey, c.SessionToken, c.ExternalID, c.Credhub.ClientSecret}
+}
+
+// loadOptions - AWS config options selecting the base credentials source
+func (c *credentialsConfig) loadOptions() ([]func(*config.LoadOptions) error, error) {
+	var opts []func(*config.LoadOptions) error
+	if len(c.AccessKeyID) != 0 {
+		accessKeyID, err := c.AccessKeyID.resolve()
+		if err != nil {
+			return nil, fmt.Errorf("invalid access key id: %w", err)
+		}
+		secretAccessKey, err := c.SecretAccessKey.resolve()
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret access key: %w", err)
+		}
+		sessionToken, err := c.SessionToken.resolve()
+		if err != nil {
+			return nil, fmt.Errorf("invalid session token: %w", err)
+		}
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(
+				accessKeyID,
+				secretAccessKey,
+				sessionToken,
+			),
+		))
+	}
+	if len(c.Profile) != 0 {
+		opts = append(opts, config.WithSharedConfigProfile(c.Profile))
+	}
+	return opts, nil
+}
+
+// provider - Wraps base credentials with role assumption when configured,
+// returns nil when base credentials must be used as is
+func (c *credentialsConfig) provider(cfg aws.Config) (aws.CredentialsProvider, error) {
+	if c.Type == credentialsCredhub {
+		provider, err := newCredhubProvider(&c.Credhub)
+		if err != nil {
+			return nil, err
+		}
+		return aws.NewCredentialsCache(provider), nil
+	}
+
+	var stsOpts []func(*sts.Options)
+	if len(c.STSURL) != 0 {
+		stsOpts = append(stsOpts, func(o *sts.Options) {
+			o.BaseEndpoint = aws.String(c.STSURL)
+		})
+	}
+	client := sts.NewFromConfig(cfg, stsOpts...)
+
+	switch c.Type {
+	case credentialsAssumeRole:
+		externalID, err := c.ExternalID.resolve()
+		if err != nil {
+			return nil, fmt.Errorf("invalid external id: %w", err)
+		}
+		return aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(client, c.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+			o.RoleSessionName = c.SessionName
+			if len(externalID) != 0 {
+				o.ExternalID = aws.String(externalID)
+			}
+			if c.Duration != 0 {
+				o.Duration = c.Duration
+			}
+		})), nil
+	case credentialsWebIdentity:
+		return aws.NewCredentialsCache(stscreds.NewWebIdentityRoleProvider(
+			client,
+			c.RoleARN,
+			stscreds.IdentityTokenFile(c.WebIdentityTokenFile),
+			func(o *stscreds.WebIdentityRoleOptions) {
+				o.RoleSessionName = c.SessionName
+				if c.Duration != 0 {
+					o.Duration = c.Duration
+				}
+			},
+		)), nil
+	}
+	return nil, nil
+}
+
+// CredentialsExpiry - Expiration time of the credentials currently in use,
+// zero time when they never expire
+func (m *Manager) CredentialsExpiry() (time.Time, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	creds, err := m.client.Options().Credentials.Retrieve(context.Background())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to retrieve credentials: %w", err)
+	}
+	if !creds.CanExpire {
+		return time.Time{}, nil
+	}
+	return creds.Expires, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const credentialsCredhub = "credhub"
+
+type credhubConfig struct {
+	URL                 string        `yaml:"url"`
+	UAAURL              string        `yaml:"uaa_url"`
+	ClientID            string        `yaml:"client_id"`
+	ClientSecret        secret        `yaml:"client_secret"`
+	CAFile              string        `yaml:"ca_file"`
+	CertFile            string        `yaml:"cert_file"`
+	KeyFile             string        `yaml:"key_file"`
+	AccessKeyIDName     string        `yaml:"access_key_id_name"`
+	SecretAccessKeyName string        `yaml:"secret_access_key_name"`
+	RefreshInterval     time.Duration `yaml:"refresh_interval"`
+}
+
+func (c *credhubConfig) validate(path string, errs *configErrors) {
+	if len(c.URL) == 0 {
+		errs.add(path+".url", "missing mandatory key")
+	}
+	if len(c.ClientID) == 0 && len(c.CertFile) == 0 {
+		errs.add(path, "missing key client_id or cert_file")
+	}
+	if len(c.CertFile) != 0 && len(c.KeyFile) == 0 {
+		errs.add(path+".key_file", "missing key, mandatory with cert_file")
+	}
+	if len(c.AccessKeyIDName) == 0 {
+		errs.add(path+".access_key_id_name", "missing mandatory key")
+	}
+	if len(c.SecretAccessKeyName) == 0 {
+		errs.add(path+".secret_access_key_name", "missing mandatory key")
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = 10 * time.Minute
+	}
+}
+
+// credentialFetchError - Failure to obtain credentials from an external store
+type credentialFetchError struct {
+	err error
+}
+
+func (e *credentialFetchError) Error() string {
+	return fmt.Sprintf("unable to fetch credentials: %s", e.err)
+}
+
+func (e *credentialFetchError) Unwrap() error {
+	return e.err
+}
+
+// credhubProvider - AWS credentials provider reading S3 keys from CredHub
+type credhubProvider struct {
+	config      *credhubConfig
+	client      *http.Client
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+func newCredhubProvider(config *credhubConfig) (*credhubProvider, error) {
+	tlsCfg, err := (&tlsConfig{
+		CAFile:   config.CAFile,
+		CertFile: config.CertFile,
+		KeyFile:  config.KeyFile,
+	}).build()
+	if err != nil {
+		return nil, fmt.Errorf("invalid credhub tls configuration: %w", err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	return &credhubProvider{
+		config: config,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   30 * time.Second,
+		},
+	}, nil
+}
+
+// Retrieve - Implements aws.CredentialsProvider
+func (p *credhubProvider) Retrieve(ctx context.Context) (aws.Credentials, error) {
+	accessKeyID, err := p.fetch(ctx, p.config.AccessKeyIDName, "access_key_id", "username")
+	if err != nil {
+		return aws.Credentials{}, &credentialFetchError{err: err}
+	}
+	secretAccessKey, err := p.fetch(ctx, p.config.SecretAccessKeyName, "secret_access_key", "password")
+	if err != nil {
+		return aws.Credentials{}, &credentialFetchError{err: err}
+	}
+	return aws.Credentials{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		Source:          "CredHub",
+		CanExpire:       true,
+		Expires:         time.Now().Add(p.config.RefreshInterval),
+	}, nil
+}
+
+// fetch - Reads current value of named credential, structured values are
+// searched for the first present of given fields
+func (p *credhubProvider) fetch(ctx context.Context, name string, fields ...string) (string, error) {
+	u := fmt.Sprintf("%s/api/v1/data?%s", strings.TrimSuffix(p.config.URL, "/"), url.Values{
+		"name":    []string{name},
+		"current": []string{"true"},
+	}.Encode())
+	res := struct {
+		Data []struct {
+			Value json.RawMessage `json:"value"`
+		} `json:"data"`
+	}{}
+	if err := p.get(ctx, u, &res); err != nil {
+		return "", fmt.Errorf("unable to get credhub credential '%s': %w", name, err)
+	}
+	if len(res.Data) == 0 {
+		return "", fmt.Errorf("credhub credential '%s' not found", name)
+	}
+
+	var value string
+	if err := json.Unmarshal(res.Data[0].Value, &value); err == nil {
+		return value, nil
+	}
+	values := map[string]any{}
+	if err := json.Unmarshal(res.Data[0].Value, &values); err != nil {
+		return "", fmt.Errorf("unsupported value for credhub credential '%s'", name)
+	}
+	for _, f := range fields {
+		if v, ok := values[f].(string); ok {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("credhub credential '%s' has none of fields %s", name, strings.Join(fields, ", "))
+}
+
+func (p *credhubProvider) get(ctx context.Context, u string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	if len(p.config.ClientID) != 0 {
+		token, err := p.uaaToken(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return p.do(req, out)
+}
+
+func (p *credhubProvider) do(req *http.Request, out any) error {
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from '%s': %s", res.StatusCode, req.URL.Host, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// uaaToken - Returns a cached client credentials token, requesting a new one
+// when expired
+func (p *credhubProvider) uaaToken(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.token) != 0 && time.Now().Before(p.tokenExpiry) {
+		return p.token, nil
+	}
+
+	uaaURL := p.config.UAAURL
+	if len(uaaURL) == 0 {
+		info := struct {
+			AuthServer struct {
+				URL string `json:"url"`
+			} `json:"auth-server"`
+		}{}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(p.config.URL, "/")+"/info", nil)
+		if err != nil {
+			return "", err
+		}
+		if err := p.do(req, &info); err != nil {
+			return "", fmt.Errorf("unable to discover uaa url: %w", err)
+		}
+		uaaURL = info.AuthServer.URL
+	}
+
+	secret, err := p.config.ClientSecret.resolve()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{"grant_type": []string{"client_credentials"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(uaaURL, "/")+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(secret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	if err := p.do(req, &res); err != nil {
+		return "", fmt.Errorf("unable to get uaa token: %w", err)
+	}
+	p.token = res.AccessToken
+	// renew token slightly before actual expiry
+	p.tokenExpiry = time.Now().Add(time.Duration(res.ExpiresIn)*time.Second - 30*time.Second)
+	return p.token, nil
+}
@@ -1,94 +1,432 @@
 package main
 
 import (
-	// "fmt"
+	"context"
+	"crypto/tls"
+	"errors"
+	"maps"
+	"slices"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"time"
 )
 
+// probeLabelNames - Labels identifying the target and route of a probe
+var probeLabelNames = []string{"target", "backend_ip", "connection"}
+
 var (
-	uploadDuration   prometheus.Gauge
-	uploadStatus     prometheus.Gauge
+	uploadDuration   *prometheus.GaugeVec
+	uploadStatus     *prometheus.GaugeVec
 	uploadError      *prometheus.GaugeVec
-	downloadDuration prometheus.Gauge
-	downloadStatus   prometheus.Gauge
+	downloadDuration *prometheus.GaugeVec
+	downloadStatus   *prometheus.GaugeVec
 	downloadError    *prometheus.GaugeVec
+	bucketExposed    *prometheus.GaugeVec
+	bucketBlocked    *prometheus.GaugeVec
+	credsExpiry      *prometheus.GaugeVec
+	tlsCertNotAfter  *prometheus.GaugeVec
+	tlsInfo          *prometheus.GaugeVec
+	authFailures     *prometheus.CounterVec
+	setupError       *prometheus.GaugeVec
+	selfRepairs      *prometheus.CounterVec
+
+	janitorLeakedObjects *prometheus.GaugeVec
+	janitorLeakedBytes   *prometheus.GaugeVec
+	janitorLeakedUploads *prometheus.GaugeVec
+	janitorDeleted       *prometheus.CounterVec
+	janitorAborted       *prometheus.CounterVec
+	janitorSuccess       *prometheus.GaugeVec
+
+	configReloadSuccess prometheus.Gauge
+	configReloadTime    prometheus.Gauge
 )
 
 func loadMetricsReporter(namespace string) {
-	downloadDuration = promauto.NewGauge(
+	downloadDuration = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "download_duration_seconds",
 			Help:      "Last download duration in seconds",
-		})
-	uploadDuration = promauto.NewGauge(
+		}, probeLabelNames,
+	)
+	uploadDuration = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "upload_duration_seconds",
 			Help:      "Last upload duration in seconds",
-		})
+		}, probeLabelNames,
+	)
 
-	downloadStatus = promauto.NewGauge(
+	downloadStatus = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "download_status",
 			Help:      "Last download status, 1 is ok",
-		})
-	uploadStatus = promauto.NewGauge(
+		}, probeLabelNames,
+	)
+	uploadStatus = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "upload_status",
 			Help:      "Last upload status, 1 is ok",
-		})
+		}, probeLabelNames,
+	)
 
 	downloadError = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "download_errors",
 			Help:      "Active download errors",
-		}, []string{"error"},
+		}, append(slices.Clone(probeLabelNames), "error", "reason"),
 	)
 	uploadError = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "upload_errors",
 			Help:      "Active upload errors",
-		}, []string{"error"},
+		}, append(slices.Clone(probeLabelNames), "error", "reason"),
+	)
+
+	bucketExposed = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "bucket_publicly_accessible",
+			Help:      "Operation succeeded on bucket without credentials, 1 is exposed",
+		}, []string{"target", "bucket", "operation"},
+	)
+	bucketBlocked = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "bucket_public_access_blocked",
+			Help:      "All public access block settings are enabled on bucket, 1 is blocked",
+		}, []string{"target", "bucket"},
+	)
+
+	credsExpiry = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "credentials_expiry_timestamp_seconds",
+			Help:      "Expiration time of the S3 credentials in use, 0 when they never expire",
+		}, []string{"target"},
+	)
+
+	tlsCertNotAfter = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "tls_cert_not_after_timestamp_seconds",
+			Help:      "Expiration time of certificates presented by the S3 endpoint",
+		}, []string{"target", "backend_ip", "subject", "issuer", "serial"},
+	)
+	tlsInfo = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "tls_connection_info",
+			Help:      "TLS version and cipher suite negotiated with the S3 endpoint",
+		}, []string{"target", "backend_ip", "version", "cipher_suite"},
+	)
+
+	authFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_auth_failures_total",
+			Help:      "Requests rejected by bearer token validation",
+		}, []string{"route", "reason"},
+	)
+
+	setupError = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "setup_error",
+			Help:      "Probes failed on missing bucket or reference object during last cycle, 1 is failed",
+		}, []string{"target", "reason"},
+	)
+	selfRepairs = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "self_repairs_total",
+			Help:      "Successful repairs of missing bucket or reference object",
+		}, []string{"target", "reason"},
+	)
+
+	janitorLeakedObjects = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "janitor_leaked_objects",
+			Help:      "Objects older than janitor max age left under janitor prefix after last run",
+		}, []string{"target"},
+	)
+	janitorLeakedBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "janitor_leaked_bytes",
+			Help:      "Size of objects older than janitor max age left under janitor prefix after last run",
+		}, []string{"target"},
+	)
+	janitorLeakedUploads = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "janitor_leaked_multipart_uploads",
+			Help:      "Incomplete multipart uploads older than janitor multipart max age left after last run",
+		}, []string{"target"},
 	)
+	janitorDeleted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "janitor_deleted_objects_total",
+			Help:      "Leaked objects deleted by janitor",
+		}, []string{"target"},
+	)
+	janitorAborted = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "janitor_aborted_multipart_uploads_total",
+			Help:      "Incomplete multipart uploads aborted by janitor",
+		}, []string{"target"},
+	)
+	janitorSuccess = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "janitor_last_run_successful",
+			Help:      "Last janitor run status, 1 is ok",
+		}, []string{"target"},
+	)
+
+	configReloadSuccess = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_successful",
+			Help:      "Last configuration reload status, 1 is ok",
+		},
+	)
+	configReloadTime = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "config_last_reload_success_timestamp_seconds",
+			Help:      "Time of last successful configuration reload",
+		},
+	)
+}
+
+// errorReason - Classifies probe errors
+func errorReason(err error) string {
+	var fetchErr *credentialFetchError
+	problem := setupProblem(err)
+	switch {
+	case errors.As(err, &fetchErr):
+		return "credential_fetch"
+	case errors.Is(err, errContentMismatch):
+		return "content_mismatch"
+	case len(problem) != 0:
+		return problem
+	}
+	return "request"
 }
 
-// RecordMetrics -
+// RecordMetrics - Runs probe loop of target until manager is stopped
 func RecordMetrics(manager *Manager) {
 	go func() {
+		defer close(manager.done)
 		for {
-			downloadError.Reset()
-			start := time.Now()
-			if err := manager.Download(); err != nil {
-				downloadError.With(prometheus.Labels{
-					"error": err.Error(),
-				}).Set(1)
-				downloadStatus.Set(0)
-			} else {
-				downloadStatus.Set(1)
-				downloadDuration.Set(time.Since(start).Seconds())
+			recordTarget(manager)
+			select {
+			case <-manager.stop:
+				return
+			case <-time.After(manager.config.Exporter.IntervalDuration):
 			}
+		}
+	}()
+}
 
-			uploadError.Reset()
-			start = time.Now()
-			if err := manager.Upload(); err != nil {
-				uploadError.With(prometheus.Labels{
-					"error": err.Error(),
-				}).Set(1)
-				uploadStatus.Set(0)
-			} else {
-				uploadStatus.Set(1)
-				uploadDuration.Set(time.Since(start).Seconds())
+// recordTarget - Runs probes of a single target and updates its metrics
+func recordTarget(manager *Manager) {
+	target := prometheus.Labels{"target": manager.target.Name}
+	// a hung request must not hold the cycle, and Stop waiting on it, forever
+	ctx, cancel := context.WithTimeout(context.Background(), manager.config.Exporter.IntervalDuration)
+	defer cancel()
+
+	if expiry, err := manager.CredentialsExpiry(); err == nil {
+		value := 0.0
+		if !expiry.IsZero() {
+			value = float64(expiry.Unix())
+		}
+		credsExpiry.With(target).Set(value)
+	}
+
+	routes := manager.Routes()
+	for _, r := range manager.probedRoutes {
+		if !slices.Contains(routes, r) {
+			deleteRouteMetrics(routeLabels(manager, r))
+			manager.dropResults(r)
+		}
+	}
+	manager.probedRoutes = routes
+	problems := map[string]bool{}
+	for _, r := range routes {
+		for _, err := range recordRoute(ctx, manager, r) {
+			if problem := setupProblem(err); len(problem) != 0 {
+				problems[problem] = true
 			}
-			time.Sleep(manager.config.Exporter.IntervalDuration)
 		}
-	}()
+	}
+	recordSetup(ctx, manager, problems)
+
+	if time.Since(manager.lastStaleClean) >= staleKeysInterval {
+		manager.lastStaleClean = time.Now()
+		if err := manager.CleanStaleKeys(ctx); err != nil {
+			manager.entry.Warnf("unable to clean stale upload keys: %s", err)
+		}
+	}
+
+	tlsCertNotAfter.DeletePartialMatch(target)
+	tlsInfo.DeletePartialMatch(target)
+	for backend, state := range manager.TLSStates() {
+		for _, cert := range state.PeerCertificates {
+			tlsCertNotAfter.With(prometheus.Labels{
+				"target":     manager.target.Name,
+				"backend_ip": backend,
+				"subject":    cert.Subject.String(),
+				"issuer":     cert.Issuer.String(),
+				"serial":     cert.SerialNumber.String(),
+			}).Set(float64(cert.NotAfter.Unix()))
+		}
+		tlsInfo.With(prometheus.Labels{
+			"target":       manager.target.Name,
+			"backend_ip":   backend,
+			"version":      tls.VersionName(state.Version),
+			"cipher_suite": tls.CipherSuiteName(state.CipherSuite),
+		}).Set(1)
+	}
+
+	if exposures := manager.CheckExposure(ctx); exposures != nil {
+		bucketExposed.DeletePartialMatch(target)
+		bucketBlocked.DeletePartialMatch(target)
+		for _, e := range exposures {
+			for op, exposed := range e.Operations {
+				value := 0.0
+				if exposed {
+					value = 1
+				}
+				bucketExposed.With(prometheus.Labels{
+					"target":    manager.target.Name,
+					"bucket":    e.Bucket,
+					"operation": op,
+				}).Set(value)
+			}
+			if e.Blocked != nil {
+				value := 0.0
+				if *e.Blocked {
+					value = 1
+				}
+				bucketBlocked.With(prometheus.Labels{
+					"target": manager.target.Name,
+					"bucket": e.Bucket,
+				}).Set(value)
+			}
+		}
+	}
+	manager.endCycle()
+}
+
+// recordSetup - Reports setup problems found by probes of a target and
+// repairs them when enabled
+func recordSetup(ctx context.Context, manager *Manager, problems map[string]bool) {
+	for _, problem := range setupProblems {
+		value := 0.0
+		if problems[problem] {
+			value = 1
+		}
+		setupError.With(prometheus.Labels{"target": manager.target.Name, "reason": problem}).Set(value)
+	}
+	if !manager.target.SelfRepair.Enabled || len(problems) == 0 {
+		return
+	}
+
+	// a missing bucket implies a missing reference object
+	problem := setupMissingObject
+	if problems[setupMissingBucket] {
+		problem = setupMissingBucket
+	}
+	manager.entry.Warnf("repairing setup of target: %s", problem)
+	if err := manager.Repair(ctx, problem); err != nil {
+		manager.entry.Errorf("unable to repair setup of target: %s", err)
+		return
+	}
+	selfRepairs.With(prometheus.Labels{"target": manager.target.Name, "reason": problem}).Inc()
+}
+
+// recordRoute - Runs probes of a target through given route, returns their
+// errors
+func recordRoute(ctx context.Context, manager *Manager, r route) []error {
+	labels := routeLabels(manager, r)
+
+	downloadError.DeletePartialMatch(labels)
+	start := time.Now()
+	downloadErr := manager.Download(ctx, r)
+	duration := time.Since(start)
+	manager.recordResult("download", r, duration, downloadErr)
+	if downloadErr != nil {
+		downloadError.With(errorLabels(labels, downloadErr)).Set(1)
+		downloadStatus.With(labels).Set(0)
+	} else {
+		downloadStatus.With(labels).Set(1)
+		downloadDuration.With(labels).Set(duration.Seconds())
+	}
+
+	uploadError.DeletePartialMatch(labels)
+	start = time.Now()
+	err := manager.Upload(ctx, r)
+	duration = time.Since(start)
+	manager.recordResult("upload", r, duration, err)
+	if err != nil {
+		uploadError.With(errorLabels(labels, err)).Set(1)
+		uploadStatus.With(labels).Set(0)
+	} else {
+		uploadStatus.With(labels).Set(1)
+		uploadDuration.With(labels).Set(duration.Seconds())
+	}
+	return []error{downloadErr, err}
+}
+
+func routeLabels(manager *Manager, r route) prometheus.Labels {
+	return prometheus.Labels{
+		"target":     manager.target.Name,
+		"backend_ip": r.Backend,
+		"connection": r.Connection,
+	}
+}
+
+func errorLabels(labels prometheus.Labels, err error) prometheus.Labels {
+	res := maps.Clone(labels)
+	res["error"] = err.Error()
+	res["reason"] = errorReason(err)
+	return res
+}
+
+// deleteTargetMetrics - Drops series of a target removed from configuration
+func deleteTargetMetrics(name string) {
+	labels := prometheus.Labels{"target": name}
+	for _, vec := range []*prometheus.GaugeVec{
+		downloadDuration, downloadStatus, downloadError,
+		uploadDuration, uploadStatus, uploadError,
+		bucketExposed, bucketBlocked, credsExpiry, tlsCertNotAfter, tlsInfo, setupError,
+		janitorLeakedObjects, janitorLeakedBytes, janitorLeakedUploads, janitorSuccess,
+	} {
+		vec.DeletePartialMatch(labels)
+	}
+	for _, vec := range []*prometheus.CounterVec{selfRepairs, janitorDeleted, janitorAborted} {
+		vec.DeletePartialMatch(labels)
+	}
+}
+
+// deleteRouteMetrics - Drops series of a route no longer probed
+func deleteRouteMetrics(labels prometheus.Labels) {
+	for _, vec := range []*prometheus.GaugeVec{
+		downloadDuration, downloadStatus, downloadError,
+		uploadDuration, uploadStatus, uploadError,
+	} {
+		vec.DeletePartialMatch(labels)
+	}
 }
 
 // Local Variables:
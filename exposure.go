@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// bucketExposure - Result of anonymous access checks on a single bucket
+type bucketExposure struct {
+	Bucket string
+	// Operations maps each checked operation (get, list, put, policy) to
+	// true when it unexpectedly succeeded
+	Operations map[string]bool
+	// Blocked is nil when the endpoint does not support public access blocks
+	Blocked *bool
+}
+
+// CheckExposure - Attempts unsigned operations against probe and watched buckets
+func (m *Manager) CheckExposure(ctx context.Context) []bucketExposure {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.anonClient == nil {
+		return nil
+	}
+
+	buckets := []watchedBucket{{
+		Name: m.target.Bucket,
+		Key:  m.downloadKey(),
+	}}
+	buckets = append(buckets, m.target.Exposure.Buckets...)
+
+	res := make([]bucketExposure, 0, len(buckets))
+	for _, b := range buckets {
+		res = append(res, m.checkBucketExposure(ctx, b))
+	}
+	return res
+}
+
+func (m *Manager) checkBucketExposure(ctx context.Context, b watchedBucket) bucketExposure {
+	entry := m.entry.WithField("watched_bucket", b.Name)
+	res := bucketExposure{
+		Bucket:     b.Name,
+		Operations: map[string]bool{},
+	}
+
+	exposureKey := m.exposureKey()
+	key := b.Key
+	if len(key) == 0 {
+		key = exposureKey
+	}
+
+	out, err := m.anonClient.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(b.Name),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		_, _ = io.Copy(io.Discard, out.Body)
+		_ = out.Body.Close()
+		entry.Errorf("object '%s' is readable without credentials", key)
+	}
+	res.Operations["get"] = err == nil
+
+	_, err = m.anonClient.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(b.Name),
+		MaxKeys: aws.Int32(1),
+	})
+	if err == nil {
+		entry.Errorf("bucket is listable without credentials")
+	}
+	res.Operations["list"] = err == nil
+
+	_, err = m.anonClient.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(b.Name),
+		Key:    aws.String(exposureKey),
+		Body:   bytes.NewReader([]byte("s3rw exposure check")),
+	})
+	res.Operations["put"] = err == nil
+	if err == nil {
+		entry.Errorf("bucket is writable without credentials")
+		// anonymous write usually comes with anonymous delete, target
+		// credentials often have no rights on watched buckets
+		input := &s3.DeleteObjectInput{
+			Bucket: aws.String(b.Name),
+			Key:    aws.String(exposureKey),
+		}
+		if _, anonErr := m.anonClient.DeleteObject(ctx, input); anonErr != nil {
+			if _, err = m.client.DeleteObject(ctx, input); err != nil {
+				entry.Warnf("unable to remove anonymously written object '%s', object is left behind: anonymous delete: %s, signed delete: %s",
+					exposureKey, anonErr.Error(), err.Error())
+			}
+		}
+	}
+
+	status, err := m.client.GetBucketPolicyStatus(ctx, &s3.GetBucketPolicyStatusInput{
+		Bucket: aws.String(b.Name),
+	})
+	if err != nil {
+		entry.Debugf("unable to get bucket policy status: %s", err.Error())
+	} else {
+		public := status.PolicyStatus != nil && aws.ToBool(status.PolicyStatus.IsPublic)
+		if public {
+			entry.Errorf("bucket policy is public")
+		}
+		res.Operations["policy"] = public
+	}
+
+	block, err := m.client.GetPublicAccessBlock(ctx, &s3.GetPublicAccessBlockInput{
+		Bucket: aws.String(b.Name),
+	})
+	var apiErr smithy.APIError
+	switch {
+	case err == nil:
+		c := block.PublicAccessBlockConfiguration
+		blocked := c != nil &&
+			aws.ToBool(c.BlockPublicAcls) &&
+			aws.ToBool(c.BlockPublicPolicy) &&
+			aws.ToBool(c.IgnorePublicAcls) &&
+			aws.ToBool(c.RestrictPublicBuckets)
+		res.Blocked = &blocked
+	case errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchPublicAccessBlockConfiguration":
+		res.Blocked = aws.Bool(false)
+	default:
+		entry.Debugf("unable to get public access block: %s", err.Error())
+	}
+
+	return res
+}
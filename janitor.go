@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// janitorConfig - Periodic cleanup of objects and multipart uploads left
+// under the exporter's dedicated prefix
+type janitorConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	Prefix          string        `yaml:"prefix"`
+	Interval        time.Duration `yaml:"interval"`
+	MaxAge          time.Duration `yaml:"max_age"`
+	MultipartMaxAge time.Duration `yaml:"multipart_max_age"`
+}
+
+func (c *janitorConfig) validate(path string, errs *configErrors) {
+	if !c.Enabled {
+		return
+	}
+	// an empty prefix would let the janitor sweep the whole bucket
+	if len(c.Prefix) == 0 {
+		errs.add(path+".prefix", "missing mandatory key")
+	} else if len(strings.Trim(c.Prefix, "/")) == 0 {
+		errs.add(path+".prefix", "must not be the bucket root")
+	}
+	if c.Interval == 0 {
+		c.Interval = time.Hour
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = 24 * time.Hour
+	}
+	if c.MultipartMaxAge == 0 {
+		c.MultipartMaxAge = 24 * time.Hour
+	}
+	if c.Interval < 0 || c.MaxAge < 0 || c.MultipartMaxAge < 0 {
+		errs.add(path, "durations must be positive")
+	}
+}
+
+// janitorReport - Outcome of a janitor run
+type janitorReport struct {
+	LeakedObjects int
+	LeakedBytes   int64
+	LeakedUploads int
+	Deleted       int
+	DeletedBytes  int64
+	Aborted       int
+}
+
+// Sweep - Deletes objects under janitor prefix older than max age and aborts
+// multipart uploads older than multipart max age, current reference object
+// and upload key are kept
+func (m *Manager) Sweep(ctx context.Context) (janitorReport, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	config := m.target.Janitor
+	bucket := aws.String(m.target.Bucket)
+	leaked := m.leakedObject()
+
+	var res janitorReport
+	var objects []s3types.ObjectIdentifier
+	sizes := map[string]int64{}
+	paginator := s3.NewListObjectsV2Paginator(m.client, &s3.ListObjectsV2Input{
+		Bucket: bucket,
+		Prefix: aws.String(config.Prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return res, fmt.Errorf("unable to list objects under '%s': %w", config.Prefix, err)
+		}
+		for _, o := range page.Contents {
+			key := aws.ToString(o.Key)
+			if !leaked(key, aws.ToTime(o.LastModified)) {
+				continue
+			}
+			res.LeakedObjects++
+			res.LeakedBytes += aws.ToInt64(o.Size)
+			sizes[key] = aws.ToInt64(o.Size)
+			objects = append(objects, s3types.ObjectIdentifier{Key: o.Key})
+		}
+	}
+
+	uploads := s3.NewListMultipartUploadsPaginator(m.client, &s3.ListMultipartUploadsInput{
+		Bucket: bucket,
+		Prefix: aws.String(config.Prefix),
+	})
+	var leakedUploads []s3types.MultipartUpload
+	for uploads.HasMorePages() {
+		page, err := uploads.NextPage(ctx)
+		if err != nil {
+			return res, fmt.Errorf("unable to list multipart uploads under '%s': %w", config.Prefix, err)
+		}
+		for _, u := range page.Uploads {
+			if time.Since(aws.ToTime(u.Initiated)) >= config.MultipartMaxAge {
+				leakedUploads = append(leakedUploads, u)
+			}
+		}
+	}
+	res.LeakedUploads = len(leakedUploads)
+
+	deleted, errs := deleteObjects(ctx, m.client, m.target.Bucket, objects)
+	res.Deleted = deleted
+	res.DeletedBytes = res.LeakedBytes
+	for _, err := range errs {
+		var deleteErr *deleteError
+		if errors.As(err, &deleteErr) {
+			res.DeletedBytes -= sizes[deleteErr.Key]
+		}
+	}
+	if len(errs) != 0 {
+		return res, fmt.Errorf("%d objects left under '%s': %w", len(errs), config.Prefix, errs[0])
+	}
+
+	for _, u := range leakedUploads {
+		_, err := m.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   bucket,
+			Key:      u.Key,
+			UploadId: u.UploadId,
+		})
+		if err != nil {
+			return res, fmt.Errorf("unable to abort multipart upload of '%s': %w", aws.ToString(u.Key), err)
+		}
+		res.Aborted++
+	}
+	return res, nil
+}
+
+// leakedObject - Filter of objects listed under janitor prefix that the
+// janitor deletes, reference objects of every target and instance and current
+// upload key are kept, as well as objects younger than max age
+func (m *Manager) leakedObject() func(key string, modified time.Time) bool {
+	_, reference := m.keys.download.pattern(keyData{})
+	current := m.uploadKey()
+	maxAge := m.target.Janitor.MaxAge
+	return func(key string, modified time.Time) bool {
+		return key != current && !reference.MatchString(key) && time.Since(modified) >= maxAge
+	}
+}
+
+// RunJanitor - Runs cleanup of target on its own interval until manager is
+// stopped
+func RunJanitor(manager *Manager) {
+	if !manager.target.Janitor.Enabled {
+		close(manager.janitorDone)
+		return
+	}
+	go func() {
+		defer close(manager.janitorDone)
+		for {
+			recordJanitor(manager)
+			select {
+			case <-manager.stop:
+				return
+			case <-time.After(manager.target.Janitor.Interval):
+			}
+		}
+	}()
+}
+
+// recordJanitor - Runs a single cleanup of target and updates its metrics
+func recordJanitor(manager *Manager) {
+	target := prometheus.Labels{"target": manager.target.Name}
+	report, err := manager.Sweep(context.Background())
+
+	// leaks cleaned up by this run are no longer reported
+	janitorLeakedObjects.With(target).Set(float64(report.LeakedObjects - report.Deleted))
+	janitorLeakedBytes.With(target).Set(float64(report.LeakedBytes - report.DeletedBytes))
+	janitorLeakedUploads.With(target).Set(float64(report.LeakedUploads - report.Aborted))
+	janitorDeleted.With(target).Add(float64(report.Deleted))
+	janitorAborted.With(target).Add(float64(report.Aborted))
+	if err != nil {
+		manager.entry.Errorf("janitor run failed: %s", err)
+		janitorSuccess.With(target).Set(0)
+		return
+	}
+	if report.Deleted != 0 || report.Aborted != 0 {
+		manager.entry.Infof("janitor deleted %d objects (%d bytes) and aborted %d multipart uploads under '%s'",
+			report.Deleted, report.DeletedBytes, report.Aborted, manager.target.Janitor.Prefix)
+	}
+	janitorSuccess.With(target).Set(1)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeakedObject(t *testing.T) {
+	target := s3Config{
+		Name:        "a",
+		DownloadKey: "probes/ref/{{.Target}}",
+		UploadKey:   "probes/{{.InstanceID}}/u",
+		Janitor:     janitorConfig{Enabled: true, Prefix: "probes/", MaxAge: time.Hour},
+	}
+	leaked := newTestManager(t, target, "i1").leakedObject()
+	old := time.Now().Add(-2 * time.Hour)
+	recent := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name     string
+		key      string
+		modified time.Time
+		leaked   bool
+	}{
+		{name: "old object", key: "probes/i2/u", modified: old, leaked: true},
+		{name: "old unrelated object", key: "probes/something", modified: old, leaked: true},
+		{name: "recent object", key: "probes/i2/u", modified: recent},
+		{name: "current upload key", key: "probes/i1/u", modified: old},
+		{name: "own reference", key: "probes/ref/a", modified: old},
+		{name: "reference of other target", key: "probes/ref/b", modified: old},
+		{name: "nested under reference", key: "probes/ref/a/x", modified: old, leaked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := leaked(tt.key, tt.modified); got != tt.leaked {
+				t.Errorf("leaked(%q) = %v, want %v", tt.key, got, tt.leaked)
+			}
+		})
+	}
+}
+
+func TestJanitorConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config janitorConfig
+		err    string
+	}{
+		{name: "disabled", config: janitorConfig{}},
+		{name: "prefix", config: janitorConfig{Enabled: true, Prefix: "probes/"}},
+		{name: "missing prefix", config: janitorConfig{Enabled: true}, err: "janitor.prefix: missing mandatory key"},
+		{name: "root prefix", config: janitorConfig{Enabled: true, Prefix: "/"}, err: "janitor.prefix: must not be the bucket root"},
+		{name: "slashes prefix", config: janitorConfig{Enabled: true, Prefix: "//"}, err: "janitor.prefix: must not be the bucket root"},
+		{name: "negative age", config: janitorConfig{Enabled: true, Prefix: "p/", MaxAge: -time.Hour}, err: "durations must be positive"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := configErrors{}
+			tt.config.validate("janitor", &errs)
+			if len(tt.err) == 0 {
+				if len(errs) != 0 {
+					t.Fatalf("unexpected errors: %s", errs)
+				}
+				return
+			}
+			if !strings.Contains(errs.Error(), tt.err) {
+				t.Fatalf("expected error containing %q, got %q", tt.err, errs.Error())
+			}
+		})
+	}
+}
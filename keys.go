@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+const (
+	// staleKeysInterval - Minimum time between two cleanups of stale upload keys
+	staleKeysInterval = time.Hour
+	// keyMarker - Delimits field values when looking for fields in rendered keys
+	keyMarker = "\x00"
+)
+
+// runID - Identifier of exporter process, changes on each start
+var runID = newRunID()
+
+func newRunID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(b)
+}
+
+// keyData - Values available to object key templates
+type keyData struct {
+	Hostname   string
+	InstanceID string
+	Target     string
+	Date       string
+	RunID      string
+}
+
+// newKeyData - Template values of target at given time, instance identifier
+// is taken from configuration, then from Cloud Foundry environment, then
+// defaults to host name
+func newKeyData(exporter exporterConfig, target string, now time.Time) keyData {
+	hostname, _ := os.Hostname()
+	instanceID := exporter.InstanceID
+	if len(instanceID) == 0 {
+		instanceID = os.Getenv("CF_INSTANCE_GUID")
+	}
+	if len(instanceID) == 0 {
+		instanceID = hostname
+	}
+	return keyData{
+		Hostname:   hostname,
+		InstanceID: instanceID,
+		Target:     target,
+		Date:       now.UTC().Format(time.DateOnly),
+		RunID:      runID,
+	}
+}
+
+// keyTemplate - Object key accepting {{.Field}} references to keyData
+type keyTemplate struct {
+	text string
+	tmpl *template.Template
+}
+
+func parseKeyTemplate(text string) (*keyTemplate, error) {
+	tmpl, err := template.New("key").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	t := &keyTemplate{text: text, tmpl: tmpl}
+	if _, err := t.execute(keyData{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// validateKeyTemplate - Reports invalid key template at given path, keys of
+// templated objects are listed and deleted by stale key cleanup and teardown
+// so they must start with a literal path segment keeping unrelated objects
+// out of reach, fields varying between runs are forbidden in fixed keys
+func validateKeyTemplate(path string, text string, fixed bool, errs *configErrors) {
+	t, err := parseKeyTemplate(text)
+	if err != nil {
+		errs.add(path, "invalid key template: %s", err)
+		return
+	}
+	if !t.templated() {
+		return
+	}
+	if prefix, _ := t.pattern(keyData{}); !strings.Contains(prefix, "/") {
+		errs.add(path, "templated key must start with a literal path segment, e.g. probes/{{.InstanceID}}")
+	}
+	if fixed {
+		for _, field := range []string{"Date", "RunID"} {
+			if slices.Contains(t.fields(), field) {
+				errs.add(path, "{{.%s}} is not allowed, object is seeded once", field)
+			}
+		}
+	}
+}
+
+func (t *keyTemplate) execute(data keyData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(buf.String(), "/"), nil
+}
+
+// render - Key for given values, template text when it cannot be executed
+func (t *keyTemplate) render(data keyData) string {
+	key, err := t.execute(data)
+	if err != nil {
+		return t.text
+	}
+	return key
+}
+
+// templated - Key changes with template values
+func (t *keyTemplate) templated() bool {
+	return strings.Contains(t.text, "{{")
+}
+
+// markedKey - Key rendered with each field replaced by a marker holding its
+// name, fields set in fixed keep their value
+func (t *keyTemplate) markedKey(fixed keyData) string {
+	mark := func(name string, value string) string {
+		if len(value) != 0 {
+			return value
+		}
+		return keyMarker + name + keyMarker
+	}
+	return t.render(keyData{
+		Hostname:   mark("Hostname", fixed.Hostname),
+		InstanceID: mark("InstanceID", fixed.InstanceID),
+		Target:     mark("Target", fixed.Target),
+		Date:       mark("Date", fixed.Date),
+		RunID:      mark("RunID", fixed.RunID),
+	})
+}
+
+// fields - Names of fields used by template
+func (t *keyTemplate) fields() []string {
+	parts := strings.Split(t.markedKey(keyData{}), keyMarker)
+	var res []string
+	for i := 1; i < len(parts); i += 2 {
+		res = append(res, parts[i])
+	}
+	return res
+}
+
+// pattern - Literal prefix shared by all keys of template and expression
+// matching any of them, fields set in fixed only match their value, template
+// values are assumed free of slashes
+func (t *keyTemplate) pattern(fixed keyData) (string, *regexp.Regexp) {
+	key := regexp.MustCompile(keyMarker+"[A-Za-z]+"+keyMarker).ReplaceAllString(t.markedKey(fixed), keyMarker)
+	prefix, _, _ := strings.Cut(key, keyMarker)
+	parts := strings.Split(key, keyMarker)
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	return prefix, regexp.MustCompile("^" + strings.Join(parts, "[^/]+") + "$")
+}
+
+// objectKeys - Templates of keys read and written by probes
+type objectKeys struct {
+	download *keyTemplate
+	upload   *keyTemplate
+	exposure *keyTemplate
+}
+
+func newObjectKeys(target *s3Config) (objectKeys, error) {
+	var res objectKeys
+	var err error
+	if res.download, err = parseKeyTemplate(target.DownloadKey); err != nil {
+		return res, fmt.Errorf("invalid download_file_name template: %w", err)
+	}
+	if res.upload, err = parseKeyTemplate(target.UploadKey); err != nil {
+		return res, fmt.Errorf("invalid upload_file_name template: %w", err)
+	}
+	if res.exposure, err = parseKeyTemplate(target.Exposure.Key); err != nil {
+		return res, fmt.Errorf("invalid exposure key template: %w", err)
+	}
+	return res, nil
+}
+
+func (m *Manager) keyData() keyData {
+	return newKeyData(m.config.Exporter, m.target.Name, time.Now())
+}
+
+// downloadKey - Current key of reference object
+func (m *Manager) downloadKey() string {
+	return m.keys.download.render(m.keyData())
+}
+
+// uploadKey - Current key of object written by upload probe
+func (m *Manager) uploadKey() string {
+	return m.keys.upload.render(m.keyData())
+}
+
+// exposureKey - Current key of object written by unsigned upload check
+func (m *Manager) exposureKey() string {
+	return m.keys.exposure.render(m.keyData())
+}
+
+// CleanStaleKeys - Deletes upload objects of other instances, runs or days
+// not written for longer than configured age
+func (m *Manager) CleanStaleKeys(ctx context.Context) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	maxAge := m.target.StaleKeyMaxAge
+	if maxAge == 0 || !m.keys.upload.templated() {
+		return nil
+	}
+
+	// keys of other targets sharing the bucket are left to their own cleanup
+	prefix, pattern := m.keys.upload.pattern(keyData{Target: m.target.Name})
+	current := m.uploadKey()
+	var objects []s3types.ObjectIdentifier
+	paginator := s3.NewListObjectsV2Paginator(m.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(m.target.Bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to list objects under '%s': %w", prefix, err)
+		}
+		for _, o := range page.Contents {
+			key := aws.ToString(o.Key)
+			if key == current || !pattern.MatchString(key) || time.Since(aws.ToTime(o.LastModified)) < maxAge {
+				continue
+			}
+			objects = append(objects, s3types.ObjectIdentifier{Key: o.Key})
+		}
+	}
+
+	deleted, errs := deleteObjects(ctx, m.client, m.target.Bucket, objects)
+	if deleted != 0 {
+		m.entry.Infof("deleted %d stale upload objects under '%s'", deleted, prefix)
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("%d stale objects left under '%s': %w", len(errs), prefix, errs[0])
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateKeyTemplate(t *testing.T) {
+	tests := []struct {
+		name  string
+		text  string
+		fixed bool
+		err   string
+	}{
+		{name: "literal", text: "test-upload"},
+		{name: "literal segment", text: "probes/{{.InstanceID}}/test-upload"},
+		{name: "leading slash", text: "/probes/{{.RunID}}"},
+		{name: "date in upload key", text: "probes/{{.Date}}/test-upload"},
+		{name: "field first", text: "{{.Hostname}}", err: "must start with a literal path segment"},
+		{name: "field in first segment", text: "{{.InstanceID}}.probe", err: "must start with a literal path segment"},
+		{name: "prefix without slash", text: "probes-{{.Target}}/u", err: "must start with a literal path segment"},
+		{name: "slash after field", text: "/{{.Target}}/u", err: "must start with a literal path segment"},
+		{name: "unknown field", text: "probes/{{.Bogus}}", err: "invalid key template"},
+		{name: "syntax", text: "probes/{{.Target", err: "invalid key template"},
+		{name: "fixed instance", text: "ref/{{.InstanceID}}/d", fixed: true},
+		{name: "fixed date", text: "ref/{{.Date}}/d", fixed: true, err: "{{.Date}} is not allowed"},
+		{name: "fixed run", text: "ref/{{.RunID}}/d", fixed: true, err: "{{.RunID}} is not allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := configErrors{}
+			validateKeyTemplate("s3.key", tt.text, tt.fixed, &errs)
+			if len(tt.err) == 0 {
+				if len(errs) != 0 {
+					t.Fatalf("unexpected errors: %s", errs)
+				}
+				return
+			}
+			if len(errs) == 0 || !strings.Contains(errs.Error(), tt.err) {
+				t.Fatalf("expected error containing %q, got %q", tt.err, errs.Error())
+			}
+			if !strings.HasPrefix(errs[0], "s3.key: ") {
+				t.Errorf("error not prefixed with path: %q", errs[0])
+			}
+		})
+	}
+}
+
+func TestKeyTemplatePattern(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		fixed  keyData
+		prefix string
+		match  []string
+		reject []string
+	}{
+		{
+			name:   "literal",
+			text:   "test-upload",
+			prefix: "test-upload",
+			match:  []string{"test-upload"},
+			reject: []string{"test-upload2", "a/test-upload", "test"},
+		},
+		{
+			name:   "any instance",
+			text:   "probes/{{.InstanceID}}/u",
+			prefix: "probes/",
+			match:  []string{"probes/a/u", "probes/exporter-0/u"},
+			reject: []string{"probes/u", "probes//u", "probes/a/b/u", "probes/a/u2", "other/a/u"},
+		},
+		{
+			name:   "fixed target",
+			text:   "probes/{{.Target}}/{{.InstanceID}}/u",
+			fixed:  keyData{Target: "a"},
+			prefix: "probes/a/",
+			match:  []string{"probes/a/i1/u", "probes/a/i2/u"},
+			reject: []string{"probes/b/i1/u", "probes/ab/i1/u"},
+		},
+		{
+			name:   "fixed value quoted",
+			text:   "probes/{{.Target}}/u",
+			fixed:  keyData{Target: "a.b"},
+			prefix: "probes/a.b/u",
+			match:  []string{"probes/a.b/u"},
+			reject: []string{"probes/aXb/u"},
+		},
+		{
+			name:   "fields in segment",
+			text:   "probes/{{.Date}}-{{.RunID}}.bin",
+			prefix: "probes/",
+			match:  []string{"probes/2026-01-01-abcd.bin"},
+			reject: []string{"probes/x.bin", "probes/a-b.binx", "probes/a/b-c.bin"},
+		},
+		{
+			name:   "fixed instance with varying date",
+			text:   "probes/{{.InstanceID}}/{{.Date}}",
+			fixed:  keyData{InstanceID: "i1", Target: "unused"},
+			prefix: "probes/i1/",
+			match:  []string{"probes/i1/2026-01-01"},
+			reject: []string{"probes/i2/2026-01-01"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := parseKeyTemplate(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			prefix, pattern := tmpl.pattern(tt.fixed)
+			if prefix != tt.prefix {
+				t.Errorf("prefix = %q, want %q", prefix, tt.prefix)
+			}
+			for _, key := range tt.match {
+				if !pattern.MatchString(key) {
+					t.Errorf("%s does not match %q", pattern, key)
+				}
+				if !strings.HasPrefix(key, prefix) {
+					t.Errorf("matching key %q outside of prefix %q", key, prefix)
+				}
+			}
+			for _, key := range tt.reject {
+				if pattern.MatchString(key) {
+					t.Errorf("%s matches %q", pattern, key)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyTemplateFields(t *testing.T) {
+	tmpl, err := parseKeyTemplate("p/{{.Target}}/{{.InstanceID}}-{{.Target}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := tmpl.fields()
+	want := []string{"Target", "InstanceID", "Target"}
+	if strings.Join(fields, ",") != strings.Join(want, ",") {
+		t.Errorf("fields = %v, want %v", fields, want)
+	}
+}
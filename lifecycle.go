@@ -0,0 +1,385 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// lifecycleRuleID - Identifier of lifecycle rule managed by the exporter,
+	// other rules of bucket are kept
+	lifecycleRuleID = "s3rw-exporter"
+	// benchKeyPrefix - Parent prefix of keys written by bench command
+	benchKeyPrefix = "s3rw-bench/"
+)
+
+// bucketSettings - Optional bucket configuration applied by init command,
+// unset values leave bucket as is
+type bucketSettings struct {
+	Versioning *bool           `yaml:"versioning"`
+	Encryption string          `yaml:"encryption"`
+	KMSKeyID   string          `yaml:"kms_key_id"`
+	Lifecycle  lifecycleConfig `yaml:"lifecycle"`
+}
+
+type lifecycleConfig struct {
+	Prefix                       string `yaml:"prefix"`
+	ExpirationDays               int32  `yaml:"expiration_days"`
+	NoncurrentExpirationDays     int32  `yaml:"noncurrent_expiration_days"`
+	AbortIncompleteMultipartDays int32  `yaml:"abort_incomplete_multipart_days"`
+}
+
+func (c *bucketSettings) validate(path string, errs *configErrors) {
+	switch c.Encryption {
+	case "", string(s3types.ServerSideEncryptionAes256):
+		if len(c.KMSKeyID) != 0 {
+			errs.add(path+".kms_key_id", "only allowed with aws:kms encryption")
+		}
+	case string(s3types.ServerSideEncryptionAwsKms):
+	default:
+		errs.add(path+".encryption", "invalid value '%s', must be one of AES256, aws:kms", c.Encryption)
+	}
+	l := c.Lifecycle
+	if l.ExpirationDays < 0 || l.NoncurrentExpirationDays < 0 || l.AbortIncompleteMultipartDays < 0 {
+		errs.add(path+".lifecycle", "days must be positive")
+	}
+}
+
+// enabled - Lifecycle rule is configured
+func (c *lifecycleConfig) enabled() bool {
+	return c.ExpirationDays != 0 || c.NoncurrentExpirationDays != 0 || c.AbortIncompleteMultipartDays != 0
+}
+
+// rule - Lifecycle rule managed by the exporter
+func (c *lifecycleConfig) rule() s3types.LifecycleRule {
+	rule := s3types.LifecycleRule{
+		ID:     aws.String(lifecycleRuleID),
+		Status: s3types.ExpirationStatusEnabled,
+		Filter: &s3types.LifecycleRuleFilter{Prefix: aws.String(c.Prefix)},
+	}
+	if c.ExpirationDays != 0 {
+		rule.Expiration = &s3types.LifecycleExpiration{Days: aws.Int32(c.ExpirationDays)}
+	}
+	if c.NoncurrentExpirationDays != 0 {
+		rule.NoncurrentVersionExpiration = &s3types.NoncurrentVersionExpiration{
+			NoncurrentDays: aws.Int32(c.NoncurrentExpirationDays),
+		}
+	}
+	if c.AbortIncompleteMultipartDays != 0 {
+		rule.AbortIncompleteMultipartUpload = &s3types.AbortIncompleteMultipartUpload{
+			DaysAfterInitiation: aws.Int32(c.AbortIncompleteMultipartDays),
+		}
+	}
+	return rule
+}
+
+// Init - Creates bucket, applies configured bucket settings and seeds
+// reference object
+func (m *Manager) Init(ctx context.Context) error {
+	if err := m.CreateBucket(ctx); err != nil {
+		return err
+	}
+	if err := m.ApplyBucketSettings(ctx); err != nil {
+		return err
+	}
+	return m.Seed(ctx)
+}
+
+// ApplyBucketSettings - Configures versioning, encryption and lifecycle rule
+// of bucket when set
+func (m *Manager) ApplyBucketSettings(ctx context.Context) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	settings := m.target.BucketSettings
+	bucket := aws.String(m.target.Bucket)
+
+	if settings.Versioning != nil {
+		status := s3types.BucketVersioningStatusSuspended
+		if *settings.Versioning {
+			status = s3types.BucketVersioningStatusEnabled
+		}
+		m.entry.Infof("setting versioning of bucket '%s' to %s", m.target.Bucket, status)
+		_, err := m.client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+			Bucket:                  bucket,
+			VersioningConfiguration: &s3types.VersioningConfiguration{Status: status},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to set versioning: %w", err)
+		}
+	}
+
+	if len(settings.Encryption) != 0 {
+		m.entry.Infof("setting default encryption of bucket '%s' to %s", m.target.Bucket, settings.Encryption)
+		def := &s3types.ServerSideEncryptionByDefault{
+			SSEAlgorithm: s3types.ServerSideEncryption(settings.Encryption),
+		}
+		if len(settings.KMSKeyID) != 0 {
+			def.KMSMasterKeyID = aws.String(settings.KMSKeyID)
+		}
+		_, err := m.client.PutBucketEncryption(ctx, &s3.PutBucketEncryptionInput{
+			Bucket: bucket,
+			ServerSideEncryptionConfiguration: &s3types.ServerSideEncryptionConfiguration{
+				Rules: []s3types.ServerSideEncryptionRule{{ApplyServerSideEncryptionByDefault: def}},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to set encryption: %w", err)
+		}
+	}
+
+	if settings.Lifecycle.enabled() {
+		m.entry.Infof("setting lifecycle rule '%s' of bucket '%s'", lifecycleRuleID, m.target.Bucket)
+		rules, err := m.lifecycleRules(ctx)
+		if err != nil {
+			return err
+		}
+		rules = slices.DeleteFunc(rules, func(r s3types.LifecycleRule) bool {
+			return aws.ToString(r.ID) == lifecycleRuleID
+		})
+		rules = append(rules, settings.Lifecycle.rule())
+		_, err = m.client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+			Bucket:                 bucket,
+			LifecycleConfiguration: &s3types.BucketLifecycleConfiguration{Rules: rules},
+		})
+		if err != nil {
+			return fmt.Errorf("unable to set lifecycle rules: %w", err)
+		}
+	}
+	return nil
+}
+
+// lifecycleRules - Current lifecycle rules of bucket, empty when bucket has
+// no lifecycle configuration
+func (m *Manager) lifecycleRules(ctx context.Context) ([]s3types.LifecycleRule, error) {
+	out, err := m.client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(m.target.Bucket),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchLifecycleConfiguration" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get lifecycle rules: %w", err)
+	}
+	return out.Rules, nil
+}
+
+// Verify - Checks that bucket state matches configuration
+func (m *Manager) Verify(ctx context.Context) []targetCheck {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	settings := m.target.BucketSettings
+	bucket := aws.String(m.target.Bucket)
+
+	var res []targetCheck
+	_, err := m.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: bucket})
+	res = append(res, targetCheck{Name: "bucket exists", Err: err})
+	if err != nil {
+		return res
+	}
+
+	if settings.Versioning != nil {
+		out, err := m.client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{Bucket: bucket})
+		if err == nil {
+			enabled := out.Status == s3types.BucketVersioningStatusEnabled
+			if enabled != *settings.Versioning {
+				err = fmt.Errorf("versioning status is '%s'", out.Status)
+			}
+		}
+		res = append(res, targetCheck{Name: "versioning", Err: err})
+	}
+
+	if len(settings.Encryption) != 0 {
+		out, err := m.client.GetBucketEncryption(ctx, &s3.GetBucketEncryptionInput{Bucket: bucket})
+		if err == nil {
+			found := slices.ContainsFunc(out.ServerSideEncryptionConfiguration.Rules, func(r s3types.ServerSideEncryptionRule) bool {
+				def := r.ApplyServerSideEncryptionByDefault
+				return def != nil && string(def.SSEAlgorithm) == settings.Encryption &&
+					(len(settings.KMSKeyID) == 0 || aws.ToString(def.KMSMasterKeyID) == settings.KMSKeyID)
+			})
+			if !found {
+				err = fmt.Errorf("default encryption is not %s", settings.Encryption)
+			}
+		}
+		res = append(res, targetCheck{Name: "encryption", Err: err})
+	}
+
+	if settings.Lifecycle.enabled() {
+		rules, err := m.lifecycleRules(ctx)
+		if err == nil {
+			idx := slices.IndexFunc(rules, func(r s3types.LifecycleRule) bool {
+				return aws.ToString(r.ID) == lifecycleRuleID
+			})
+			if idx == -1 {
+				err = fmt.Errorf("lifecycle rule '%s' not found", lifecycleRuleID)
+			} else if !sameLifecycleRule(rules[idx], settings.Lifecycle.rule()) {
+				err = fmt.Errorf("lifecycle rule '%s' differs from configuration", lifecycleRuleID)
+			}
+		}
+		res = append(res, targetCheck{Name: "lifecycle", Err: err})
+	}
+
+	out, err := m.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: bucket,
+		Key:    aws.String(m.downloadKey()),
+	})
+	if err == nil {
+		var content bytes.Buffer
+		_, err = content.ReadFrom(out.Body)
+		out.Body.Close()
+		if err == nil && !bytes.Equal(content.Bytes(), m.downloadFile) {
+			err = errContentMismatch
+		}
+	}
+	res = append(res, targetCheck{Name: "reference object", Err: err})
+	return res
+}
+
+func sameLifecycleRule(a, b s3types.LifecycleRule) bool {
+	days := func(v *int32) int32 {
+		return aws.ToInt32(v)
+	}
+	prefix := func(r s3types.LifecycleRule) string {
+		if r.Filter != nil && r.Filter.Prefix != nil {
+			return *r.Filter.Prefix
+		}
+		return aws.ToString(r.Prefix)
+	}
+	expiration := func(r s3types.LifecycleRule) int32 {
+		if r.Expiration == nil {
+			return 0
+		}
+		return days(r.Expiration.Days)
+	}
+	noncurrent := func(r s3types.LifecycleRule) int32 {
+		if r.NoncurrentVersionExpiration == nil {
+			return 0
+		}
+		return days(r.NoncurrentVersionExpiration.NoncurrentDays)
+	}
+	abort := func(r s3types.LifecycleRule) int32 {
+		if r.AbortIncompleteMultipartUpload == nil {
+			return 0
+		}
+		return days(r.AbortIncompleteMultipartUpload.DaysAfterInitiation)
+	}
+	return a.Status == b.Status && prefix(a) == prefix(b) && expiration(a) == expiration(b) &&
+		noncurrent(a) == noncurrent(b) && abort(a) == abort(b)
+}
+
+// keyMatch - Keys written by the exporter, listed under prefix
+type keyMatch struct {
+	prefix  string
+	pattern *regexp.Regexp
+}
+
+// createdKeys - Keys the exporter writes to for this target, templated keys
+// match any run or day, and any instance unless instance_id is configured
+func (m *Manager) createdKeys() []keyMatch {
+	templates := []*keyTemplate{m.keys.download, m.keys.upload}
+	if m.target.Exposure.Enabled {
+		templates = append(templates, m.keys.exposure)
+	}
+	keys := []keyMatch{{
+		prefix:  benchKeyPrefix,
+		pattern: regexp.MustCompile("^" + regexp.QuoteMeta(benchKeyPrefix)),
+	}}
+	fixed := keyData{Target: m.target.Name, InstanceID: m.config.Exporter.InstanceID}
+	for _, t := range templates {
+		prefix, pattern := t.pattern(fixed)
+		keys = append(keys, keyMatch{prefix: prefix, pattern: pattern})
+	}
+	return keys
+}
+
+// createdBy - Key was written by the exporter
+func createdBy(keys []keyMatch, key string) bool {
+	return slices.ContainsFunc(keys, func(k keyMatch) bool {
+		return k.pattern.MatchString(key)
+	})
+}
+
+// Teardown - Deletes all versions of objects written by the exporter, aborts
+// their incomplete multipart uploads and optionally deletes bucket
+func (m *Manager) Teardown(ctx context.Context, deleteBucket bool) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	bucket := aws.String(m.target.Bucket)
+	keys := m.createdKeys()
+
+	for _, k := range keys {
+		prefix := k.prefix
+		paginator := s3.NewListObjectVersionsPaginator(m.client, &s3.ListObjectVersionsInput{
+			Bucket: bucket,
+			Prefix: aws.String(prefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("unable to list versions under '%s': %w", prefix, err)
+			}
+			var objects []s3types.ObjectIdentifier
+			for _, v := range page.Versions {
+				if createdBy(keys, aws.ToString(v.Key)) {
+					objects = append(objects, s3types.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+				}
+			}
+			for _, d := range page.DeleteMarkers {
+				if createdBy(keys, aws.ToString(d.Key)) {
+					objects = append(objects, s3types.ObjectIdentifier{Key: d.Key, VersionId: d.VersionId})
+				}
+			}
+			if len(objects) == 0 {
+				continue
+			}
+			deleted, errs := deleteObjects(ctx, m.client, m.target.Bucket, objects)
+			m.entry.Infof("deleted %d object versions under '%s'", deleted, prefix)
+			if len(errs) != 0 {
+				return fmt.Errorf("%d object versions left under '%s': %w", len(errs), prefix, errs[0])
+			}
+		}
+
+		uploads := s3.NewListMultipartUploadsPaginator(m.client, &s3.ListMultipartUploadsInput{
+			Bucket: bucket,
+			Prefix: aws.String(prefix),
+		})
+		for uploads.HasMorePages() {
+			page, err := uploads.NextPage(ctx)
+			if err != nil {
+				return fmt.Errorf("unable to list multipart uploads under '%s': %w", prefix, err)
+			}
+			for _, u := range page.Uploads {
+				if !createdBy(keys, aws.ToString(u.Key)) {
+					continue
+				}
+				_, err := m.client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+					Bucket:   bucket,
+					Key:      u.Key,
+					UploadId: u.UploadId,
+				})
+				if err != nil {
+					return fmt.Errorf("unable to abort multipart upload of '%s': %w", aws.ToString(u.Key), err)
+				}
+				m.entry.Infof("aborted multipart upload of '%s'", aws.ToString(u.Key))
+			}
+		}
+	}
+
+	if !deleteBucket {
+		return nil
+	}
+	m.entry.Infof("deleting bucket '%s'", m.target.Bucket)
+	if _, err := m.client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: bucket}); err != nil {
+		return fmt.Errorf("unable to delete bucket '%s': %w", m.target.Bucket, err)
+	}
+	return nil
+}
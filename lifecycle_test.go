@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+)
+
+// newTestManager - Manager of given target without S3 clients, enough for
+// key selection logic
+func newTestManager(t *testing.T, target s3Config, instanceID string) *Manager {
+	t.Helper()
+	keys, err := newObjectKeys(&target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Manager{
+		config: &Config{Exporter: exporterConfig{InstanceID: instanceID}},
+		target: &target,
+		keys:   keys,
+	}
+}
+
+func TestCreatedBy(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     s3Config
+		instanceID string
+		created    []string
+		foreign    []string
+	}{
+		{
+			name:    "literal keys",
+			target:  s3Config{Name: "a", DownloadKey: "test-download", UploadKey: "test-upload"},
+			created: []string{"test-download", "test-upload", "s3rw-bench/1/00000001"},
+			foreign: []string{"test-download.bak", "other", "probes/test-upload", "s3rw-bench"},
+		},
+		{
+			name: "templated keys of own target only",
+			target: s3Config{
+				Name:        "a",
+				DownloadKey: "ref/{{.Target}}/d",
+				UploadKey:   "probes/{{.Target}}/{{.InstanceID}}/{{.Date}}",
+			},
+			created: []string{"ref/a/d", "probes/a/i1/2026-01-01", "probes/a/i2/2026-01-02"},
+			foreign: []string{"ref/b/d", "probes/b/i1/2026-01-01", "probes/a/i1", "probes/a/i1/x/y"},
+		},
+		{
+			name: "configured instance",
+			target: s3Config{
+				Name:        "a",
+				DownloadKey: "ref/d",
+				UploadKey:   "probes/{{.InstanceID}}/{{.RunID}}",
+			},
+			instanceID: "i1",
+			created:    []string{"ref/d", "probes/i1/abcd"},
+			foreign:    []string{"probes/i2/abcd"},
+		},
+		{
+			name: "exposure key",
+			target: s3Config{
+				Name:        "a",
+				DownloadKey: "d",
+				UploadKey:   "u",
+				Exposure:    exposureConfig{Enabled: true, Key: "exposure/{{.Target}}"},
+			},
+			created: []string{"exposure/a"},
+			foreign: []string{"exposure/b"},
+		},
+		{
+			name: "exposure disabled",
+			target: s3Config{
+				Name:        "a",
+				DownloadKey: "d",
+				UploadKey:   "u",
+				Exposure:    exposureConfig{Key: "exposure/{{.Target}}"},
+			},
+			foreign: []string{"exposure/a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := newTestManager(t, tt.target, tt.instanceID).createdKeys()
+			for _, key := range tt.created {
+				if !createdBy(keys, key) {
+					t.Errorf("%q not recognized as created by exporter", key)
+				}
+			}
+			for _, key := range tt.foreign {
+				if createdBy(keys, key) {
+					t.Errorf("%q recognized as created by exporter", key)
+				}
+			}
+		})
+	}
+}
@@ -1,59 +1,383 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/alecthomas/kingpin/v2"
+	"github.com/alecthomas/units"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"os"
+	"slices"
 	"strconv"
+	"time"
 )
 
 var (
-	configFile = kingpin.Flag("config", "Configuration file path").Required().File()
-	firstRun   = kingpin.Flag("first-run", "initialize bucket and upload file expected by download check").Bool()
+	configFile = kingpin.Flag("config", "Configuration file path").Required().ExistingFile()
+	firstRun   = kingpin.Flag("first-run", "Alias of init command").Bool()
+
+	serveCmd       = kingpin.Command("serve", "Run exporter").Default()
+	checkConfigCmd = kingpin.Command("check-config", "Validate configuration and print it normalized with secrets masked")
+	preflightCmd   = kingpin.Command("preflight", "Check credentials, bucket, download object and write permission of every target")
+
+	probeCmd      = kingpin.Command("probe", "Run probes of every target once, exit code follows Nagios plugin convention")
+	probeFormat   = probeCmd.Flag("format", "Output format, one of human, json, nagios").Default("human").Enum("human", "json", "nagios")
+	probeTargets  = probeCmd.Flag("target", "Name of target to probe, may be repeated, all targets by default").Strings()
+	probeWarning  = probeCmd.Flag("warning", "Probe duration above which warning state is reported").Duration()
+	probeCritical = probeCmd.Flag("critical", "Probe duration above which critical state is reported").Duration()
+
+	initCmd     = kingpin.Command("init", "Create bucket, apply bucket settings and upload reference object of every target")
+	initTargets = initCmd.Flag("target", "Name of target to initialize, may be repeated, all targets by default").Strings()
+
+	seedCmd     = kingpin.Command("seed", "Upload reference object expected by download probe of every target")
+	seedTargets = seedCmd.Flag("target", "Name of target to seed, may be repeated, all targets by default").Strings()
+
+	verifyCmd     = kingpin.Command("verify", "Check that bucket and reference object of every target match configuration")
+	verifyTargets = verifyCmd.Flag("target", "Name of target to verify, may be repeated, all targets by default").Strings()
+
+	teardownCmd          = kingpin.Command("teardown", "Delete every object written by the exporter, including versions and incomplete multipart uploads")
+	teardownTargets      = teardownCmd.Flag("target", "Name of target to tear down, may be repeated, all targets by default").Strings()
+	teardownDeleteBucket = teardownCmd.Flag("delete-bucket", "Delete bucket once emptied of exporter objects").Bool()
+
+	benchCmd      = kingpin.Command("bench", "Run load test on bucket of a target, objects are deleted afterwards")
+	benchTarget   = benchCmd.Flag("target", "Name of target to load, first target by default").String()
+	benchWorkers  = benchCmd.Flag("workers", "Number of concurrent workers").Default("8").Int()
+	benchDuration = benchCmd.Flag("duration", "Duration of load test").Default("30s").Duration()
+	benchSizes    = benchCmd.Flag("size", "Size of written objects, may be repeated to mix sizes").Default("1MiB").Strings()
+	benchMix      = benchCmd.Flag("mix", "Weight of an operation among put, get, head, list, delete as op=weight, may be repeated").StringMap()
+	benchPrefix   = benchCmd.Flag("prefix", "Prefix of written keys, unique per run by default, only keys written by the run are deleted").String()
+	benchFormat   = benchCmd.Flag("format", "Output format, one of table, json, csv").Default("table").Enum("table", "json", "csv")
 )
 
+func applyLogConfig(c logConfig) {
+	if lvl, err := log.ParseLevel(c.Level); err == nil {
+		log.SetLevel(lvl)
+	}
+	if c.JSON {
+		log.SetFormatter(&log.JSONFormatter{})
+	} else {
+		log.SetFormatter(&log.TextFormatter{})
+	}
+}
+
+func loadConfig() (*Config, error) {
+	file, err := os.Open(*configFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open configuration file: %s", err)
+	}
+	defer file.Close()
+	return NewConfig(file)
+}
+
+func newManagers(config *Config) ([]*Manager, error) {
+	managers := make([]*Manager, 0, len(config.Targets))
+	for i := range config.Targets {
+		manager, err := NewManager(config, &config.Targets[i])
+		if err != nil {
+			return nil, fmt.Errorf("target '%s': %w", config.Targets[i].Name, err)
+		}
+		managers = append(managers, manager)
+	}
+	return managers, nil
+}
+
+// checkConfig - Implements check-config command
+func checkConfig() int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := config.Print(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// preflight - Implements preflight command
+func preflight() int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	applyLogConfig(config.Log)
+
+	res := 0
+	for i := range config.Targets {
+		target := &config.Targets[i]
+		manager, err := NewManager(config, target)
+		if err != nil {
+			printChecks(os.Stdout, target, []targetCheck{{Name: "setup", Err: err}})
+			res = 1
+			continue
+		}
+		if !printChecks(os.Stdout, target, manager.Preflight()) {
+			res = 1
+		}
+	}
+	return res
+}
+
+// lifecycle - Runs bucket lifecycle action on selected targets, stops at first
+// failure
+func lifecycle(targets []string, action func(*Manager) error) int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	applyLogConfig(config.Log)
+
+	matched := false
+	for i := range config.Targets {
+		target := &config.Targets[i]
+		if len(targets) != 0 && !slices.Contains(targets, target.Name) {
+			continue
+		}
+		matched = true
+		manager, err := NewManager(config, target)
+		if err == nil {
+			err = action(manager)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "target '%s': %s\n", target.Name, err)
+			return 1
+		}
+	}
+	if !matched {
+		fmt.Fprintln(os.Stderr, "no target matched")
+		return 1
+	}
+	return 0
+}
+
+// verify - Implements verify command
+func verify() int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	applyLogConfig(config.Log)
+
+	res := 0
+	for i := range config.Targets {
+		target := &config.Targets[i]
+		if len(*verifyTargets) != 0 && !slices.Contains(*verifyTargets, target.Name) {
+			continue
+		}
+		manager, err := NewManager(config, target)
+		if err != nil {
+			printChecks(os.Stdout, target, []targetCheck{{Name: "setup", Err: err}})
+			res = 1
+			continue
+		}
+		if !printChecks(os.Stdout, target, manager.Verify(context.Background())) {
+			res = 1
+		}
+	}
+	return res
+}
+
 func main() {
 	kingpin.Version(version.Print("s3rw"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
 
 	log.SetOutput(os.Stderr)
 	log.SetLevel(log.ErrorLevel)
 
-	config := NewConfig(*configFile)
-	if lvl, err := log.ParseLevel(config.Log.Level); err == nil {
-		log.SetLevel(lvl)
+	if *firstRun {
+		command = initCmd.FullCommand()
 	}
-	if config.Log.JSON {
-		log.SetFormatter(&log.JSONFormatter{})
+
+	ctx := context.Background()
+	switch command {
+	case initCmd.FullCommand():
+		os.Exit(lifecycle(*initTargets, func(m *Manager) error { return m.Init(ctx) }))
+	case seedCmd.FullCommand():
+		os.Exit(lifecycle(*seedTargets, func(m *Manager) error { return m.Seed(ctx) }))
+	case verifyCmd.FullCommand():
+		os.Exit(verify())
+	case teardownCmd.FullCommand():
+		os.Exit(lifecycle(*teardownTargets, func(m *Manager) error { return m.Teardown(ctx, *teardownDeleteBucket) }))
+	case checkConfigCmd.FullCommand():
+		os.Exit(checkConfig())
+	case preflightCmd.FullCommand():
+		os.Exit(preflight())
+	case probeCmd.FullCommand():
+		os.Exit(probe())
+	case benchCmd.FullCommand():
+		os.Exit(bench())
 	}
+	run()
+}
 
-	manager, err := NewManager(config)
+// probe - Implements probe command
+func probe() int {
+	fail := func(err error) int {
+		if err := printProbeError(os.Stdout, *probeFormat, err); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		return statusUnknown
+	}
+	config, err := loadConfig()
 	if err != nil {
-		panic(err)
+		return fail(err)
 	}
-	if *firstRun {
-		if err = manager.FirstRun(); err != nil {
-			log.Fatal(err.Error())
-			os.Exit(1)
+	applyLogConfig(config.Log)
+	thresholds := probeThresholds{Warning: *probeWarning, Critical: *probeCritical}
+
+	var reports []probeReport
+	for i := range config.Targets {
+		target := &config.Targets[i]
+		if len(*probeTargets) != 0 && !slices.Contains(*probeTargets, target.Name) {
+			continue
+		}
+		manager, err := NewManager(config, target)
+		if err != nil {
+			return fail(fmt.Errorf("target '%s': %w", target.Name, err))
+		}
+		reports = append(reports, manager.RunProbes(thresholds)...)
+	}
+	if len(reports) == 0 {
+		return fail(errors.New("no target matched"))
+	}
+
+	switch *probeFormat {
+	case "json":
+		if err := printProbesJSON(os.Stdout, reports); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return statusUnknown
+		}
+	case "nagios":
+		printNagios(os.Stdout, reports, thresholds)
+	default:
+		printWaterfall(os.Stdout, reports)
+	}
+	return worstStatus(reports)
+}
+
+// bench - Implements bench command
+func bench() int {
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	applyLogConfig(config.Log)
+
+	idx := 0
+	if len(*benchTarget) != 0 {
+		idx = slices.IndexFunc(config.Targets, func(t s3Config) bool {
+			return t.Name == *benchTarget
+		})
+		if idx == -1 {
+			fmt.Fprintf(os.Stderr, "unknown target '%s'\n", *benchTarget)
+			return 1
 		}
-		os.Exit(0)
 	}
 
+	if *benchWorkers < 1 || *benchDuration <= 0 {
+		fmt.Fprintln(os.Stderr, "workers and duration must be positive")
+		return 1
+	}
+	bc := benchConfig{
+		Workers:  *benchWorkers,
+		Duration: *benchDuration,
+		Mix:      benchDefaultMix,
+		Prefix:   *benchPrefix,
+	}
+	if len(bc.Prefix) == 0 {
+		bc.Prefix = fmt.Sprintf("%s%d/", benchKeyPrefix, time.Now().UnixNano())
+	}
+	for _, size := range *benchSizes {
+		value, err := units.ParseBase2Bytes(size)
+		if err != nil || value <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid size '%s'\n", size)
+			return 1
+		}
+		bc.Sizes = append(bc.Sizes, int64(value))
+	}
+	if len(*benchMix) != 0 {
+		bc.Mix = map[string]int{}
+		for op, weight := range *benchMix {
+			value, err := strconv.Atoi(weight)
+			if !slices.Contains(benchOperations, op) || err != nil || value < 0 {
+				fmt.Fprintf(os.Stderr, "invalid mix '%s=%s', operation must be one of put, get, head, list, delete with positive weight\n", op, weight)
+				return 1
+			}
+			bc.Mix[op] = value
+		}
+	}
+
+	manager, err := NewManager(config, &config.Targets[idx])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	res, err := manager.Bench(bc)
+	if res == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var printErr error
+	switch *benchFormat {
+	case "json":
+		printErr = res.printJSON(os.Stdout)
+	case "csv":
+		printErr = res.printCSV(os.Stdout)
+	default:
+		printErr = res.printTable(os.Stdout)
+	}
+	err = errors.Join(err, printErr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// run - Implements serve command, default one
+func run() {
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	applyLogConfig(config.Log)
+
+	managers, err := newManagers(config)
+	if err != nil {
+		panic(err)
+	}
 	namespace := "s3rw"
 	if config.Exporter.Namespace != "" {
 		namespace = config.Exporter.Namespace
 	}
 	loadMetricsReporter(namespace)
-	RecordMetrics(manager)
-	http.Handle(manager.config.Exporter.Path, promhttp.Handler())
-	addr := ":" + strconv.Itoa(manager.config.Exporter.Port)
-	log.Infof("listening on %s", addr)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		panic(fmt.Sprintf("unable to listen on port %d: %s", manager.config.Exporter.Port, err.Error()))
+	rt, err := newRuntime(*configFile, config, managers)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+	rt.Start()
+	http.Handle(config.Exporter.Path, rt.protect(authRouteMetrics, promhttp.Handler()))
+	http.Handle("/-/healthy", healthyHandler(rt.Managers))
+	http.Handle("/-/ready", readyHandler(rt.Managers))
+	// reload endpoint is only served when its requests can be authenticated
+	reload := rt.adminAuthenticated()
+	if reload {
+		http.Handle("/-/reload", rt.protect(authRouteAdmin, rt.reloadHandler()))
+	} else {
+		log.Infof("reload endpoint disabled, it requires exporter.oauth2 or basic authentication in web_config_file")
+	}
+	http.Handle("/", rt.protect(authRouteMetrics, landingHandler(config.Exporter.Path, reload, rt.Managers)))
+	if err := serve(config.Exporter, http.DefaultServeMux); err != nil {
+		panic(fmt.Sprintf("unable to listen on port %d: %s", config.Exporter.Port, err.Error()))
 	}
 }
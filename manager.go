@@ -3,13 +3,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/transfermanager/types"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -17,89 +20,237 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+var errContentMismatch = errors.New("downloaded file content mismatch")
+
 type Manager struct {
 	config       *Config
+	target       *s3Config
 	downloadFile []byte
 	uploadFile   []byte
 	entry        *log.Entry
+	mu           sync.RWMutex
 	client       *s3.Client
 	tmClient     *transfermanager.Client
+	anonClient   *s3.Client
+	secretFiles  map[string]time.Time
+	tlsMu        sync.Mutex
+	tlsStates    map[string]*tls.ConnectionState
+	region       string
+	routesMu     sync.Mutex
+	routeClients map[route]*transfermanager.Client
+	probedRoutes []route
+	keys         objectKeys
+	status       probeStatus
+	stop         chan struct{}
+	done         chan struct{}
+	janitorDone  chan struct{}
+
+	// lastStaleClean - Time of last cleanup of stale upload keys
+	lastStaleClean time.Time
 }
 
 // NewManager -
-func NewManager(config *Config) (*Manager, error) {
-	download, err := os.ReadFile(config.S3.DownloadFilePath)
+func NewManager(config *Config, target *s3Config) (*Manager, error) {
+	download, err := os.ReadFile(target.DownloadFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("unable read configured download file from path '%s': %s", config.S3.DownloadFilePath, err)
+		return nil, fmt.Errorf("unable read configured download file from path '%s': %s", target.DownloadFilePath, err)
 	}
-	upload, err := os.ReadFile(config.S3.UploadFilePath)
+	upload, err := os.ReadFile(target.UploadFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("unable read configured upload file from path '%s': %s", config.S3.UploadFilePath, err)
+		return nil, fmt.Errorf("unable read configured upload file from path '%s': %s", target.UploadFilePath, err)
+	}
+
+	keys, err := newObjectKeys(target)
+	if err != nil {
+		return nil, err
 	}
 
 	mgr := &Manager{
 		config:       config,
+		target:       target,
 		downloadFile: download,
 		uploadFile:   upload,
+		keys:         keys,
 		entry: log.WithFields(log.Fields{
-			"url":    config.S3.URL,
-			"bucket": config.S3.Bucket,
+			"target": target.Name,
+			"url":    target.URL,
+			"bucket": target.Bucket,
 		}),
+		secretFiles: secretFiles(target.secrets()...),
+		tlsStates:   map[string]*tls.ConnectionState{},
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		janitorDone: make(chan struct{}),
+	}
+	mgr.status.started = time.Now()
+
+	if err := mgr.buildClients(context.Background()); err != nil {
+		return nil, err
+	}
+	return mgr, nil
+}
+
+// buildClients - (Re)creates S3 clients from current configuration
+func (m *Manager) buildClients(ctx context.Context) error {
+	if len(m.region) == 0 {
+		m.region = m.target.Region
+		if len(m.region) == 0 {
+			m.region = m.discoverRegion(ctx)
+		}
 	}
 
-	// Initialize S3 client
-	client, err := mgr.newClient(context.Background())
+	client, err := m.newClient(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create S3 client: %w", err)
+		return fmt.Errorf("unable to create S3 client: %w", err)
 	}
-	mgr.client = client
-	mgr.tmClient = transfermanager.New(client)
 
-	return mgr, nil
+	if _, err := client.Options().Credentials.Retrieve(ctx); err != nil {
+		m.entry.Warnf("unable to fetch credentials: %s", err)
+	}
+
+	var anonClient *s3.Client
+	if m.target.Exposure.Enabled {
+		// Unsigned client used to detect publicly accessible buckets
+		anonClient, err = m.newClient(ctx, func(o *s3.Options) {
+			o.Credentials = aws.AnonymousCredentials{}
+		})
+		if err != nil {
+			return fmt.Errorf("unable to create anonymous S3 client: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.client = client
+	m.tmClient = m.newTransferClient(client)
+	m.anonClient = anonClient
+	m.routesMu.Lock()
+	m.routeClients = map[route]*transfermanager.Client{}
+	m.routesMu.Unlock()
+	return nil
+}
+
+func (m *Manager) newTransferClient(client *s3.Client) *transfermanager.Client {
+	return transfermanager.New(client, func(o *transfermanager.Options) {
+		// default client side checksums rely on chunked payload signing
+		if m.target.Signing != signingV4 && m.target.Signing != signingV4Unchunked {
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		}
+	})
+}
+
+// WatchSecrets - Rebuilds S3 clients when referenced secret files change
+func (m *Manager) WatchSecrets() {
+	if len(m.secretFiles) == 0 {
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-time.After(m.config.Exporter.SecretsRefresh):
+			}
+			files := secretFiles(m.target.secrets()...)
+			if maps.Equal(files, m.secretFiles) {
+				continue
+			}
+			m.entry.Infof("secret files changed, rebuilding S3 clients")
+			if err := m.buildClients(context.Background()); err != nil {
+				m.entry.Errorf("unable to rebuild S3 clients with rotated secrets: %s", err)
+				continue
+			}
+			m.secretFiles = files
+		}
+	}()
+}
+
+// Start - Starts probe loop and secrets watch of target
+func (m *Manager) Start() {
+	m.WatchSecrets()
+	RecordMetrics(m)
+	RunJanitor(m)
+}
+
+// Stop - Stops background loops of target, waits for the running probe cycle
+// and janitor run to finish
+func (m *Manager) Stop() {
+	close(m.stop)
+	<-m.done
+	<-m.janitorDone
 }
 
-func (m *Manager) newClient(ctx context.Context) (*s3.Client, error) {
+func (m *Manager) newClient(ctx context.Context, optFns ...func(*s3.Options)) (*s3.Client, error) {
 	m.entry.Debugf("creating new S3 client")
 
+	credsOpts, err := m.target.Credentials.loadOptions()
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := m.newHTTPClient(route{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid transport configuration: %w", err)
+	}
 	configOpts := []func(*config.LoadOptions) error{
-		config.WithRegion(m.config.S3.Region),
-		config.WithCredentialsProvider(
-			credentials.NewStaticCredentialsProvider(
-				m.config.S3.APIKey,
-				m.config.S3.APISecret,
-				"",
-			),
-		),
+		config.WithRegion(m.region),
 	}
+	if m.target.DualStack {
+		configOpts = append(configOpts, config.WithUseDualStackEndpoint(aws.DualStackEndpointStateEnabled))
+	}
+	if m.target.FIPS {
+		configOpts = append(configOpts, config.WithUseFIPSEndpoint(aws.FIPSEndpointStateEnabled))
+	}
+	configOpts = append(configOpts, credsOpts...)
 
 	cfg, err := config.LoadDefaultConfig(ctx, configOpts...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to load AWS config: %w", err)
 	}
+	provider, err := m.target.Credentials.provider(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if provider != nil {
+		cfg.Credentials = provider
+	}
 
-	var clientOpts []func(*s3.Options)
+	// transport settings of the target only apply to S3, STS clients built
+	// from cfg keep the SDK default HTTP client
+	clientOpts := []func(*s3.Options){
+		func(o *s3.Options) {
+			o.UsePathStyle = m.target.usePathStyle()
+			o.HTTPClient = httpClient
+		},
+	}
 
-	if m.config.S3.URL != "" {
+	if m.target.URL != "" {
 		clientOpts = append(clientOpts, func(o *s3.Options) {
-			o.BaseEndpoint = aws.String(m.config.S3.URL)
-			o.UsePathStyle = true
+			o.BaseEndpoint = aws.String(m.target.URL)
 			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
 			o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
 			o.DisableLogOutputChecksumValidationSkipped = true
 		})
 	}
 
+	clientOpts = append(clientOpts, m.target.signingOptions()...)
+	clientOpts = append(clientOpts, optFns...)
 	client := s3.NewFromConfig(cfg, clientOpts...)
 	return client, nil
 }
 
-func (m *Manager) Download() error {
-	ctx := context.Background()
+func (m *Manager) Download(ctx context.Context, r route) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ctx = m.traceContext(ctx, "download", r)
 
+	tmClient, err := m.transferClient(r)
+	if err != nil {
+		return err
+	}
 	buffer := types.NewWriteAtBuffer(make([]byte, 0))
-	_, err := m.tmClient.DownloadObject(ctx, &transfermanager.DownloadObjectInput{
-		Bucket:   aws.String(m.config.S3.Bucket),
-		Key:      aws.String(m.config.S3.DownloadKey),
+	_, err = tmClient.DownloadObject(ctx, &transfermanager.DownloadObjectInput{
+		Bucket:   aws.String(m.target.Bucket),
+		Key:      aws.String(m.downloadKey()),
 		WriterAt: buffer,
 	})
 
@@ -110,27 +261,30 @@ func (m *Manager) Download() error {
 
 	if !bytes.Equal(m.downloadFile, buffer.Bytes()) {
 		m.entry.Errorf("downloaded file content mismatch")
-		return errors.New("downloaded file content mismatch")
+		return errContentMismatch
 	}
 	return nil
 }
 
-func (m *Manager) Upload() error {
-	ctx := context.Background()
+func (m *Manager) Upload(ctx context.Context, r route) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ctx = m.traceContext(ctx, "upload", r)
+
+	tmClient, err := m.transferClient(r)
+	if err != nil {
+		return err
+	}
 
 	reader := bytes.NewReader(m.uploadFile)
 
-	// Remove potential leading slash from upload key
-	key := m.config.S3.UploadKey
-	if len(key) > 0 && key[0] == '/' {
-		key = key[1:]
-	}
+	key := m.uploadKey()
 
-	m.entry.Debugf("uploading file: %s to bucket %s", key, m.config.S3.Bucket)
+	m.entry.Debugf("uploading file: %s to bucket %s", key, m.target.Bucket)
 
-	_, err := m.tmClient.UploadObject(ctx, &transfermanager.UploadObjectInput{
+	_, err = tmClient.UploadObject(ctx, &transfermanager.UploadObjectInput{
 		Body:   reader,
-		Bucket: aws.String(m.config.S3.Bucket),
+		Bucket: aws.String(m.target.Bucket),
 		Key:    aws.String(key),
 	})
 
@@ -142,16 +296,23 @@ func (m *Manager) Upload() error {
 	return nil
 }
 
-func (m *Manager) FirstRun() error {
-	ctx := context.Background()
+// CreateBucket - Creates bucket of target, an already existing bucket is not
+// an error
+func (m *Manager) CreateBucket(ctx context.Context) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	m.entry.Infof("creating bucket '%s'", m.config.S3.Bucket)
-	_, err := m.client.CreateBucket(ctx, &s3.CreateBucketInput{
-		Bucket: aws.String(m.config.S3.Bucket),
-		CreateBucketConfiguration: &s3types.CreateBucketConfiguration{
-			LocationConstraint: s3types.BucketLocationConstraint(m.config.S3.Region),
-		},
-	})
+	m.entry.Infof("creating bucket '%s'", m.target.Bucket)
+	input := &s3.CreateBucketInput{
+		Bucket: aws.String(m.target.Bucket),
+	}
+	// us-east-1 is the default location and is rejected as constraint by AWS
+	if m.region != defaultRegion {
+		input.CreateBucketConfiguration = &s3types.CreateBucketConfiguration{
+			LocationConstraint: s3types.BucketLocationConstraint(m.region),
+		}
+	}
+	_, err := m.client.CreateBucket(ctx, input)
 
 	if err != nil {
 		var bucketAlreadyExists *s3types.BucketAlreadyExists
@@ -160,17 +321,25 @@ func (m *Manager) FirstRun() error {
 		if errors.As(err, &bucketAlreadyExists) || errors.As(err, &bucketAlreadyOwnedByYou) {
 			m.entry.Warnf("bucket already exists: %s", err.Error())
 		} else {
-			return fmt.Errorf("unable to create bucket '%s': %w", m.config.S3.Bucket, err)
+			return fmt.Errorf("unable to create bucket '%s': %w", m.target.Bucket, err)
 		}
 	}
+	return nil
+}
+
+// Seed - Uploads reference object expected by download probe
+func (m *Manager) Seed(ctx context.Context) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	reader := bytes.NewReader(m.downloadFile)
 
-	m.entry.Infof("uploading initial file '%s' from '%s'", m.config.S3.DownloadKey, m.config.S3.DownloadFilePath)
-	_, err = m.tmClient.UploadObject(ctx, &transfermanager.UploadObjectInput{
+	key := m.downloadKey()
+	m.entry.Infof("uploading initial file '%s' from '%s'", key, m.target.DownloadFilePath)
+	_, err := m.tmClient.UploadObject(ctx, &transfermanager.UploadObjectInput{
 		Body:   reader,
-		Bucket: aws.String(m.config.S3.Bucket),
-		Key:    aws.String(m.config.S3.DownloadKey),
+		Bucket: aws.String(m.target.Bucket),
+		Key:    aws.String(key),
 	})
 
 	if err != nil {
@@ -179,3 +348,45 @@ func (m *Manager) FirstRun() error {
 
 	return nil
 }
+
+// deleteError - Object left in place by a batch deletion
+type deleteError struct {
+	Key       string
+	VersionID string
+	Message   string
+}
+
+func (e *deleteError) Error() string {
+	if len(e.VersionID) != 0 {
+		return fmt.Sprintf("unable to delete version '%s' of object '%s': %s", e.VersionID, e.Key, e.Message)
+	}
+	return fmt.Sprintf("unable to delete object '%s': %s", e.Key, e.Message)
+}
+
+// deleteObjects - Deletes given objects of bucket in batches, returns number
+// of deleted objects and one error per object left in place, objects of a
+// failed batch request all get its error and following batches are still sent
+func deleteObjects(ctx context.Context, client *s3.Client, bucket string, objects []s3types.ObjectIdentifier) (int, []error) {
+	deleted := 0
+	var errs []error
+	for len(objects) != 0 {
+		// DeleteObjects accepts at most 1000 keys
+		batch := objects[:min(len(objects), 1000)]
+		objects = objects[len(batch):]
+		out, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			for _, o := range batch {
+				errs = append(errs, &deleteError{Key: aws.ToString(o.Key), VersionID: aws.ToString(o.VersionId), Message: err.Error()})
+			}
+			continue
+		}
+		for _, e := range out.Errors {
+			errs = append(errs, &deleteError{Key: aws.ToString(e.Key), VersionID: aws.ToString(e.VersionId), Message: aws.ToString(e.Message)})
+		}
+		deleted += len(batch) - len(out.Errors)
+	}
+	return deleted, errs
+}
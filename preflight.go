@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// targetCheck - Outcome of a single verification of a target
+type targetCheck struct {
+	Name string
+	Err  error
+}
+
+// Preflight - Verifies credentials, bucket, download object and write
+// permission of target
+func (m *Manager) Preflight() []targetCheck {
+	m.mu.RLock()
+	client := m.client
+	m.mu.RUnlock()
+	ctx := context.Background()
+	r := route{Connection: connectionWarm}
+
+	var res []targetCheck
+	_, err := client.Options().Credentials.Retrieve(ctx)
+	res = append(res, targetCheck{Name: "credentials", Err: err})
+
+	_, err = client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(m.target.Bucket),
+	})
+	res = append(res, targetCheck{Name: "bucket exists", Err: err})
+
+	_, err = client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(m.target.Bucket),
+		Key:    aws.String(m.downloadKey()),
+	})
+	res = append(res, targetCheck{Name: "download object exists", Err: err})
+
+	err = m.Download(ctx, r)
+	res = append(res, targetCheck{Name: "download object content", Err: err})
+
+	err = m.Upload(ctx, r)
+	res = append(res, targetCheck{Name: "write permission", Err: err})
+	return res
+}
+
+// printChecks - Writes report of verifications of a target, returns
+// false when a check failed
+func printChecks(w io.Writer, target *s3Config, checks []targetCheck) bool {
+	ok := true
+	fmt.Fprintf(w, "target '%s' (bucket '%s'", target.Name, target.Bucket)
+	if len(target.URL) != 0 {
+		fmt.Fprintf(w, " on %s", target.URL)
+	}
+	fmt.Fprintln(w, "):")
+	for _, c := range checks {
+		if c.Err != nil {
+			ok = false
+			fmt.Fprintf(w, "  [FAIL] %s: %s\n", c.Name, c.Err)
+			continue
+		}
+		fmt.Fprintf(w, "  [ OK ] %s\n", c.Name)
+	}
+	return ok
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptrace"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nagios plugin exit codes
+const (
+	statusOK       = 0
+	statusWarning  = 1
+	statusCritical = 2
+	statusUnknown  = 3
+)
+
+var statusNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// waterfallWidth - Number of characters of the longest bar of timing waterfall
+const waterfallWidth = 40
+
+// phase - Time span of a step of HTTP requests
+type phase struct {
+	Name  string
+	Start time.Duration
+	End   time.Duration
+}
+
+// MarshalJSON - Durations are encoded as seconds
+func (p phase) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Name  string  `json:"name"`
+		Start float64 `json:"start_seconds"`
+		End   float64 `json:"end_seconds"`
+	}{p.Name, p.Start.Seconds(), p.End.Seconds()})
+}
+
+// phaseTimer - Records first occurrence of each step of HTTP requests made
+// during a probe
+type phaseTimer struct {
+	mu     sync.Mutex
+	start  time.Time
+	events map[string]time.Time
+}
+
+func newPhaseTimer() *phaseTimer {
+	return &phaseTimer{start: time.Now(), events: map[string]time.Time{}}
+}
+
+func (t *phaseTimer) mark(event string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.events[event]; !ok {
+		t.events[event] = time.Now()
+	}
+}
+
+// context - Context recording request steps through HTTP client trace
+func (t *phaseTimer) context(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.mark("dns_start") },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.mark("dns_done") },
+		ConnectStart:         func(string, string) { t.mark("connect_start") },
+		ConnectDone:          func(string, string, error) { t.mark("connect_done") },
+		TLSHandshakeStart:    func() { t.mark("tls_start") },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.mark("tls_done") },
+		GotConn:              func(httptrace.GotConnInfo) { t.mark("got_conn") },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark("wrote_request") },
+		GotFirstResponseByte: func() { t.mark("first_byte") },
+	})
+}
+
+// phases - Steps of first request made during probe ended at given time,
+// steps that did not happen are omitted
+func (t *phaseTimer) phases(end time.Time) []phase {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var res []phase
+	add := func(name string, from string, to time.Time) {
+		start, ok := t.events[from]
+		if !ok || to.IsZero() {
+			return
+		}
+		res = append(res, phase{Name: name, Start: start.Sub(t.start), End: to.Sub(t.start)})
+	}
+	add("dns", "dns_start", t.events["dns_done"])
+	add("connect", "connect_start", t.events["connect_done"])
+	add("tls", "tls_start", t.events["tls_done"])
+	add("request", "got_conn", t.events["wrote_request"])
+	add("wait", "wrote_request", t.events["first_byte"])
+	add("transfer", "first_byte", end)
+	return res
+}
+
+// probeReport - Outcome of a probe run from command line
+type probeReport struct {
+	Target    string        `json:"target"`
+	Operation string        `json:"operation"`
+	Backend   string        `json:"backend_ip,omitempty"`
+	Conn      string        `json:"connection,omitempty"`
+	Duration  time.Duration `json:"-"`
+	Seconds   float64       `json:"duration_seconds"`
+	Error     string        `json:"error,omitempty"`
+	Status    int           `json:"-"`
+	State     string        `json:"status"`
+	Phases    []phase       `json:"phases,omitempty"`
+}
+
+// label - Perfdata label of probe
+func (r *probeReport) label() string {
+	parts := []string{r.Target, r.Operation}
+	if len(r.Backend) != 0 {
+		parts = append(parts, r.Backend)
+	}
+	if len(r.Conn) != 0 {
+		parts = append(parts, r.Conn)
+	}
+	return strings.Join(parts, "/")
+}
+
+// probeThresholds - Durations above which probes are reported in warning or
+// critical state, zero disables threshold
+type probeThresholds struct {
+	Warning  time.Duration
+	Critical time.Duration
+}
+
+func (t probeThresholds) status(r *probeReport) int {
+	switch {
+	case len(r.Error) != 0:
+		return statusCritical
+	case t.Critical != 0 && r.Duration > t.Critical:
+		return statusCritical
+	case t.Warning != 0 && r.Duration > t.Warning:
+		return statusWarning
+	}
+	return statusOK
+}
+
+// RunProbes - Runs configured operations of target once through all of its
+// routes
+func (m *Manager) RunProbes(thresholds probeThresholds) []probeReport {
+	operations := []struct {
+		name string
+		fn   func(context.Context, route) error
+	}{
+		{"download", m.Download},
+		{"upload", m.Upload},
+	}
+
+	var res []probeReport
+	for _, r := range m.Routes() {
+		for _, op := range operations {
+			timer := newPhaseTimer()
+			err := op.fn(timer.context(context.Background()), r)
+			end := time.Now()
+			report := probeReport{
+				Target:    m.target.Name,
+				Operation: op.name,
+				Backend:   r.Backend,
+				Conn:      r.Connection,
+				Duration:  end.Sub(timer.start),
+				Phases:    timer.phases(end),
+			}
+			if err != nil {
+				report.Error = err.Error()
+			}
+			res = append(res, report)
+		}
+	}
+
+	if m.target.Exposure.Enabled {
+		start := time.Now()
+		report := probeReport{Target: m.target.Name, Operation: "exposure"}
+		var exposed []string
+		for _, e := range m.CheckExposure(context.Background()) {
+			for op, ok := range e.Operations {
+				if ok {
+					exposed = append(exposed, e.Bucket+":"+op)
+				}
+			}
+		}
+		report.Duration = time.Since(start)
+		if len(exposed) != 0 {
+			slices.Sort(exposed)
+			report.Error = "publicly accessible " + strings.Join(exposed, ", ")
+		}
+		res = append(res, report)
+	}
+
+	for i := range res {
+		res[i].Seconds = res[i].Duration.Seconds()
+		res[i].Status = thresholds.status(&res[i])
+		res[i].State = statusNames[res[i].Status]
+	}
+	return res
+}
+
+// worstStatus - Worst status of reports
+func worstStatus(reports []probeReport) int {
+	res := statusOK
+	for _, r := range reports {
+		res = max(res, r.Status)
+	}
+	return res
+}
+
+// printWaterfall - Writes human readable report with timing waterfall of
+// each probe
+func printWaterfall(w io.Writer, reports []probeReport) {
+	longest := time.Duration(0)
+	for _, r := range reports {
+		longest = max(longest, r.Duration)
+	}
+	scale := func(d time.Duration) int {
+		if longest == 0 {
+			return 0
+		}
+		return int(float64(d) / float64(longest) * waterfallWidth)
+	}
+
+	for _, r := range reports {
+		fmt.Fprintf(w, "%-8s %s %s", r.State, r.Target, r.Operation)
+		if len(r.Backend) != 0 {
+			fmt.Fprintf(w, " via %s", r.Backend)
+		}
+		if len(r.Conn) != 0 {
+			fmt.Fprintf(w, " (%s)", r.Conn)
+		}
+		fmt.Fprintf(w, " %s\n", r.Duration.Round(time.Microsecond))
+		for _, p := range r.Phases {
+			start, end := scale(p.Start), scale(p.End)
+			bar := strings.Repeat(" ", start) + strings.Repeat("=", max(end-start, 1))
+			fmt.Fprintf(w, "    %-9s |%-*s| %s\n", p.Name, waterfallWidth+1, bar, (p.End - p.Start).Round(time.Microsecond))
+		}
+		if len(r.Error) != 0 {
+			fmt.Fprintf(w, "    error: %s\n", r.Error)
+		}
+	}
+}
+
+// printProbesJSON - Writes reports as JSON document
+func printProbesJSON(w io.Writer, reports []probeReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Status string        `json:"status"`
+		Probes []probeReport `json:"probes"`
+	}{statusNames[worstStatus(reports)], reports})
+}
+
+// printNagios - Writes reports as Nagios plugin output, a status line
+// followed by details of failed probes, with performance data
+func printNagios(w io.Writer, reports []probeReport, thresholds probeThresholds) {
+	status := worstStatus(reports)
+	var failed []string
+	for _, r := range reports {
+		if r.Status != statusOK {
+			failed = append(failed, r.label())
+		}
+	}
+
+	fmt.Fprintf(w, "S3RW %s - ", statusNames[status])
+	if len(failed) == 0 {
+		fmt.Fprintf(w, "%d probes succeeded", len(reports))
+	} else {
+		fmt.Fprintf(w, "%d of %d probes failed or slow: %s", len(failed), len(reports), nagiosText(strings.Join(failed, ", ")))
+	}
+
+	perfdata := make([]string, 0, len(reports))
+	threshold := func(d time.Duration) string {
+		if d == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%g", d.Seconds())
+	}
+	for _, r := range reports {
+		perfdata = append(perfdata, fmt.Sprintf("'%s'=%.6fs;%s;%s;0",
+			nagiosText(r.label()), r.Seconds, threshold(thresholds.Warning), threshold(thresholds.Critical)))
+	}
+	fmt.Fprintf(w, " | %s\n", strings.Join(perfdata, " "))
+
+	for _, r := range reports {
+		if len(r.Error) != 0 {
+			fmt.Fprintf(w, "%s: %s\n", nagiosText(r.label()), nagiosText(r.Error))
+		}
+	}
+}
+
+// nagiosText - Text safe to print in Nagios output, where '|' starts
+// performance data
+func nagiosText(s string) string {
+	return strings.ReplaceAll(s, "|", "/")
+}
+
+// printProbeError - Writes error preventing probes from running in given
+// output format, reported as unknown status
+func printProbeError(w io.Writer, format string, err error) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Status string        `json:"status"`
+			Error  string        `json:"error"`
+			Probes []probeReport `json:"probes"`
+		}{statusNames[statusUnknown], err.Error(), []probeReport{}})
+	case "nagios":
+		_, err = fmt.Fprintf(w, "S3RW %s - %s\n", statusNames[statusUnknown], nagiosText(err.Error()))
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%-8s %s\n", statusNames[statusUnknown], err)
+	return err
+}
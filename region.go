@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	defaultRegion = "us-east-1"
+
+	addressingAuto    = "auto"
+	addressingPath    = "path"
+	addressingVirtual = "virtual"
+)
+
+// usePathStyle - Auto addressing keeps path style for custom endpoints, which
+// seldom provide wildcard DNS entries, and virtual-hosted style for AWS
+func (c *s3Config) usePathStyle() bool {
+	switch c.AddressingStyle {
+	case addressingPath:
+		return true
+	case addressingVirtual:
+		return false
+	}
+	return len(c.URL) != 0
+}
+
+// discoverRegion - Finds bucket region through HeadBucket, falling back to
+// GetBucketLocation, defaults to us-east-1
+func (m *Manager) discoverRegion(ctx context.Context) string {
+	m.region = defaultRegion
+	client, err := m.newClient(ctx)
+	if err != nil {
+		m.entry.Warnf("unable to create S3 client for region discovery: %s", err)
+		return defaultRegion
+	}
+
+	out, err := client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(m.target.Bucket),
+	})
+	if err == nil && len(aws.ToString(out.BucketRegion)) != 0 {
+		m.entry.Infof("discovered bucket region '%s'", aws.ToString(out.BucketRegion))
+		return aws.ToString(out.BucketRegion)
+	}
+	// redirect and forbidden responses still advertise the bucket region
+	var resErr *smithyhttp.ResponseError
+	if errors.As(err, &resErr) && resErr.Response != nil {
+		if region := resErr.Response.Header.Get("X-Amz-Bucket-Region"); len(region) != 0 {
+			m.entry.Infof("discovered bucket region '%s'", region)
+			return region
+		}
+	}
+
+	location, err := client.GetBucketLocation(ctx, &s3.GetBucketLocationInput{
+		Bucket: aws.String(m.target.Bucket),
+	})
+	if err != nil {
+		m.entry.Warnf("unable to discover bucket region, using '%s': %s", defaultRegion, err)
+		return defaultRegion
+	}
+	region := string(location.LocationConstraint)
+	switch region {
+	case "":
+		region = defaultRegion
+	case "EU":
+		region = "eu-west-1"
+	}
+	m.entry.Infof("discovered bucket region '%s'", region)
+	return region
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// runtime - Current configuration and managers of its targets, swapped on
+// configuration reload
+type runtime struct {
+	file     string
+	reloadMu sync.Mutex
+	mu       sync.RWMutex
+	config   *Config
+	managers []*Manager
+	auth     *tokenAuth
+
+	// webConfigFile - Web configuration of the server, fixed at startup
+	webConfigFile string
+}
+
+func newRuntime(file string, config *Config, managers []*Manager) (*runtime, error) {
+	auth, err := newTokenAuth(&config.Exporter.OAuth2)
+	if err != nil {
+		return nil, fmt.Errorf("invalid oauth2 configuration: %w", err)
+	}
+	return &runtime{
+		file:          file,
+		webConfigFile: config.Exporter.WebConfigFile,
+		config:        config,
+		managers:      managers,
+		auth:          auth,
+	}, nil
+}
+
+// Managers - Managers of currently configured targets
+func (rt *runtime) Managers() []*Manager {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.managers
+}
+
+// protect - Wraps handler with token validation of current configuration
+func (rt *runtime) protect(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt.mu.RLock()
+		auth := rt.auth
+		rt.mu.RUnlock()
+		auth.protect(route, next).ServeHTTP(w, r)
+	})
+}
+
+// Start - Starts probe loops of targets and reload triggers, SIGHUP and
+// configuration file changes when watched
+func (rt *runtime) Start() {
+	for _, m := range rt.managers {
+		m.Start()
+	}
+	configReloadSuccess.Set(1)
+	configReloadTime.SetToCurrentTime()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Infof("received SIGHUP, reloading configuration")
+			rt.Reload()
+		}
+	}()
+
+	if rt.config.Exporter.ConfigWatch != 0 {
+		go rt.watch(rt.config.Exporter.ConfigWatch)
+	}
+}
+
+// watch - Reloads configuration when file modification time or size changes
+func (rt *runtime) watch(interval time.Duration) {
+	last, err := os.Stat(rt.file)
+	if err != nil {
+		log.Errorf("unable to watch configuration file: %s", err)
+		return
+	}
+	for {
+		time.Sleep(interval)
+		info, err := os.Stat(rt.file)
+		if err != nil {
+			log.Errorf("unable to stat configuration file: %s", err)
+			continue
+		}
+		if info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		log.Infof("configuration file changed, reloading configuration")
+		rt.Reload()
+	}
+}
+
+// reloadHandler - Reloads configuration on POST requests
+func (rt *runtime) reloadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// authentication may have been removed by a reload
+		if !rt.adminAuthenticated() {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "only POST requests are allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := rt.Reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("Reloaded.\n"))
+	})
+}
+
+// Reload - Loads configuration file again, current configuration is kept
+// when new one is invalid
+func (rt *runtime) Reload() error {
+	rt.reloadMu.Lock()
+	defer rt.reloadMu.Unlock()
+	if err := rt.reload(); err != nil {
+		log.Errorf("unable to reload configuration: %s", err)
+		configReloadSuccess.Set(0)
+		return err
+	}
+	log.Infof("configuration reloaded")
+	configReloadSuccess.Set(1)
+	configReloadTime.SetToCurrentTime()
+	return nil
+}
+
+func (rt *runtime) reload() error {
+	file, err := os.Open(rt.file)
+	if err != nil {
+		return fmt.Errorf("unable to open configuration file: %w", err)
+	}
+	config, err := NewConfig(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	current := rt.config
+	if config.Exporter.Port != current.Exporter.Port ||
+		config.Exporter.Path != current.Exporter.Path ||
+		config.Exporter.Namespace != current.Exporter.Namespace ||
+		config.Exporter.ConfigWatch != current.Exporter.ConfigWatch ||
+		config.Exporter.WebConfigFile != current.Exporter.WebConfigFile {
+		log.Warnf("changes of exporter port, path, namespace, config_watch_interval and web_config_file require a restart")
+	}
+
+	auth := rt.auth
+	if !reflect.DeepEqual(config.Exporter.OAuth2, current.Exporter.OAuth2) {
+		if auth, err = newTokenAuth(&config.Exporter.OAuth2); err != nil {
+			return fmt.Errorf("invalid oauth2 configuration: %w", err)
+		}
+	}
+
+	previous := map[string]*Manager{}
+	for _, m := range rt.managers {
+		previous[m.target.Name] = m
+	}
+	managers := make([]*Manager, 0, len(config.Targets))
+	var created []*Manager
+	replaced := map[*Manager]*Manager{}
+	for i := range config.Targets {
+		target := &config.Targets[i]
+		old, ok := previous[target.Name]
+		if ok && old.matches(config, target) {
+			managers = append(managers, old)
+			delete(previous, target.Name)
+			continue
+		}
+		m, err := NewManager(config, target)
+		if err != nil {
+			return fmt.Errorf("unable to create manager of target '%s': %w", target.Name, err)
+		}
+		managers = append(managers, m)
+		created = append(created, m)
+		if ok {
+			replaced[m] = old
+			delete(previous, target.Name)
+		}
+	}
+
+	rt.mu.Lock()
+	rt.config = config
+	rt.managers = managers
+	rt.auth = auth
+	rt.mu.Unlock()
+	applyLogConfig(config.Log)
+
+	for name, m := range previous {
+		log.Infof("removing target '%s'", name)
+		m.Stop()
+		deleteTargetMetrics(name)
+	}
+	for _, m := range created {
+		if old, ok := replaced[m]; ok {
+			log.Infof("rebuilding target '%s'", m.target.Name)
+			old.Stop()
+			// settings of the new target may no longer produce some series
+			deleteTargetMetrics(m.target.Name)
+			m.inherit(old)
+		} else {
+			log.Infof("adding target '%s'", m.target.Name)
+		}
+		m.Start()
+	}
+	return nil
+}
+
+// adminAuthenticated - Requests to administration endpoints are authenticated
+// by current configuration
+func (rt *runtime) adminAuthenticated() bool {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.config.Exporter.adminAuthenticated(rt.webConfigFile)
+}
+
+// adminAuthenticated - Requests to administration endpoints are authenticated
+// either by bearer token or by basic authentication of given web configuration
+// file, the one served with rather than the configured one which may have
+// changed since startup
+func (c *exporterConfig) adminAuthenticated(webConfigFile string) bool {
+	if len(c.OAuth2.JWKSURL) != 0 {
+		return true
+	}
+	if len(webConfigFile) == 0 {
+		return false
+	}
+	content, err := os.ReadFile(webConfigFile)
+	if err != nil {
+		return false
+	}
+	var webConfig struct {
+		BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+	}
+	if err := yaml.Unmarshal(content, &webConfig); err != nil {
+		return false
+	}
+	return len(webConfig.BasicAuthUsers) != 0
+}
+
+// matches - Manager runs given target with same probe settings, position of
+// target in configuration does not matter
+func (m *Manager) matches(config *Config, target *s3Config) bool {
+	current, next := *m.target, *target
+	current.path, next.path = "", ""
+	return reflect.DeepEqual(current, next) &&
+		m.config.Exporter.IntervalDuration == config.Exporter.IntervalDuration &&
+		m.config.Exporter.SecretsRefresh == config.Exporter.SecretsRefresh &&
+		m.config.Exporter.InstanceID == config.Exporter.InstanceID
+}
+
+// inherit - Takes over probe state of the manager replaced on reload, series
+// of routes no longer probed are dropped on next cycle
+func (m *Manager) inherit(old *Manager) {
+	m.probedRoutes = old.probedRoutes
+	m.lastStaleClean = old.lastStaleClean
+	old.status.mu.Lock()
+	defer old.status.mu.Unlock()
+	m.status.mu.Lock()
+	defer m.status.mu.Unlock()
+	m.status.lastCycle = old.status.lastCycle
+	m.status.results = maps.Clone(old.status.results)
+}
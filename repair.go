@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/smithy-go"
+)
+
+// Setup problems, probe failures caused by missing bucket or reference object
+// rather than by the data path
+const (
+	setupMissingBucket = "missing_bucket"
+	setupMissingObject = "missing_object"
+)
+
+var setupProblems = []string{setupMissingBucket, setupMissingObject}
+
+type selfRepairConfig struct {
+	Enabled      bool `yaml:"enabled"`
+	CreateBucket bool `yaml:"create_bucket"`
+}
+
+// setupProblem - Setup problem behind probe error, empty when error is not
+// caused by setup
+func setupProblem(err error) string {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return ""
+	}
+	switch apiErr.ErrorCode() {
+	case "NoSuchBucket":
+		return setupMissingBucket
+	case "NoSuchKey":
+		return setupMissingObject
+	}
+	return ""
+}
+
+// Repair - Restores setup expected by probes, bucket is only recreated when
+// allowed by configuration
+func (m *Manager) Repair(ctx context.Context, problem string) error {
+	if problem == setupMissingBucket {
+		if !m.target.SelfRepair.CreateBucket {
+			return fmt.Errorf("bucket '%s' is missing and self_repair.create_bucket is disabled", m.target.Bucket)
+		}
+		if err := m.CreateBucket(ctx); err != nil {
+			return err
+		}
+		if err := m.ApplyBucketSettings(ctx); err != nil {
+			return err
+		}
+	}
+	return m.Seed(ctx)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	secretFilePrefix = "file://"
+	secretEnvPrefix  = "env:"
+	secretExecPrefix = "exec:"
+	// secretLiteralPrefix - Marks values used as is, never resolved as a
+	// reference
+	secretLiteralPrefix = "literal:"
+)
+
+// secret - Sensitive configuration value, either given in plain text or
+// referenced as file:///path, env:NAME or exec:command
+type secret string
+
+// literalSecret - Secret holding given value as is, for values coming from
+// outside of the configuration such as service bindings
+func literalSecret(value string) secret {
+	return secret(secretLiteralPrefix + value)
+}
+
+// resolve - Returns the actual secret value
+func (s secret) resolve() (string, error) {
+	value := string(s)
+	switch {
+	case strings.HasPrefix(value, secretLiteralPrefix):
+		return strings.TrimPrefix(value, secretLiteralPrefix), nil
+	case strings.HasPrefix(value, secretFilePrefix):
+		path := strings.TrimPrefix(value, secretFilePrefix)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret file '%s': %s", path, err)
+		}
+		return strings.TrimSpace(string(content)), nil
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		content, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("unable to read secret from unset environment variable '%s'", name)
+		}
+		return content, nil
+	case strings.HasPrefix(value, secretExecPrefix):
+		command := strings.TrimPrefix(value, secretExecPrefix)
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stderr = &stderr
+		content, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("unable to read secret from command '%s': %s: %s", command, err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimSpace(string(content)), nil
+	}
+	return value, nil
+}
+
+// MarshalYAML - Masks plain text values and commands, file and environment
+// references are kept as they reveal no secret
+func (s secret) MarshalYAML() (any, error) {
+	value := string(s)
+	if len(value) == 0 || strings.HasPrefix(value, secretFilePrefix) || strings.HasPrefix(value, secretEnvPrefix) {
+		return value, nil
+	}
+	return "********", nil
+}
+
+// file - Path of the referenced file, empty when secret is not a file reference
+func (s secret) file() string {
+	if !strings.HasPrefix(string(s), secretFilePrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(string(s), secretFilePrefix)
+}
+
+// secretFiles - Modification times of files referenced by given secrets
+func secretFiles(secrets ...secret) map[string]time.Time {
+	res := map[string]time.Time{}
+	for _, s := range secrets {
+		path := s.file()
+		if len(path) == 0 {
+			continue
+		}
+		res[path] = time.Time{}
+		if info, err := os.Stat(path); err == nil {
+			res[path] = info.ModTime()
+		}
+	}
+	return res
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	log "github.com/sirupsen/logrus"
+)
+
+// serve - Serves handler on configured port, TLS and authentication are read
+// from exporter-toolkit web configuration file when given
+func serve(c exporterConfig, handler http.Handler) error {
+	addr := ":" + strconv.Itoa(c.Port)
+	systemdSocket := false
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	return web.ListenAndServe(server, &web.FlagConfig{
+		WebListenAddresses: &[]string{addr},
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      &c.WebConfigFile,
+	}, slog.New(&logrusHandler{entry: log.NewEntry(log.StandardLogger())}))
+}
+
+// logrusHandler - Forwards slog records of exporter-toolkit to logrus
+type logrusHandler struct {
+	entry *log.Entry
+	group string
+}
+
+func (h *logrusHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.entry.Logger.IsLevelEnabled(logrusLevel(level))
+}
+
+func (h *logrusHandler) Handle(_ context.Context, r slog.Record) error {
+	fields := log.Fields{}
+	r.Attrs(func(a slog.Attr) bool {
+		fields[h.group+a.Key] = a.Value.Any()
+		return true
+	})
+	h.entry.WithFields(fields).Log(logrusLevel(r.Level), r.Message)
+	return nil
+}
+
+func (h *logrusHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fields := log.Fields{}
+	for _, a := range attrs {
+		fields[h.group+a.Key] = a.Value.Any()
+	}
+	return &logrusHandler{entry: h.entry.WithFields(fields), group: h.group}
+}
+
+func (h *logrusHandler) WithGroup(name string) slog.Handler {
+	return &logrusHandler{entry: h.entry, group: h.group + name + "."}
+}
+
+func logrusLevel(level slog.Level) log.Level {
+	switch {
+	case level >= slog.LevelError:
+		return log.ErrorLevel
+	case level >= slog.LevelWarn:
+		return log.WarnLevel
+	case level >= slog.LevelInfo:
+		return log.InfoLevel
+	}
+	return log.DebugLevel
+}
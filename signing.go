@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go/middleware"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+const (
+	signingV4              = "v4"
+	signingV4SignedPayload = "v4-signed-payload"
+	signingV4Unchunked     = "v4-unchunked"
+	signingV2              = "v2"
+
+	computePayloadHashID = "ComputePayloadHash"
+	// computeInputChecksumID - Middleware choosing between checksum header
+	// and aws-chunked trailer, the latter only used over HTTPS
+	computeInputChecksumID = "AWSChecksum:ComputeInputPayloadChecksum"
+)
+
+// unchunkedScheme - Stack value marking requests seen as plain HTTP by the
+// checksum middleware
+type unchunkedScheme struct{}
+
+// sigV2SubResources - Query parameters part of the SigV2 canonicalized
+// resource, sorted
+var sigV2SubResources = []string{
+	"acl",
+	"cors",
+	"delete",
+	"lifecycle",
+	"location",
+	"logging",
+	"notification",
+	"partNumber",
+	"policy",
+	"requestPayment",
+	"response-cache-control",
+	"response-content-disposition",
+	"response-content-encoding",
+	"response-content-language",
+	"response-content-type",
+	"response-expires",
+	"restore",
+	"tagging",
+	"torrent",
+	"uploadId",
+	"uploads",
+	"versionId",
+	"versioning",
+	"versions",
+	"website",
+}
+
+// signingOptions - S3 client options implementing configured signing mode
+func (c *s3Config) signingOptions() []func(*s3.Options) {
+	switch c.Signing {
+	case signingV4SignedPayload:
+		return []func(*s3.Options){func(o *s3.Options) {
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+				if _, ok := stack.Finalize.Get(computePayloadHashID); !ok {
+					return nil
+				}
+				_, err := stack.Finalize.Swap(computePayloadHashID, &v4.ComputePayloadSHA256{})
+				return err
+			})
+		}}
+	case signingV4Unchunked:
+		return []func(*s3.Options){func(o *s3.Options) {
+			// checksums are kept, only sent as headers
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenSupported
+			o.APIOptions = append(o.APIOptions, disableChunkedPayload)
+		}}
+	case signingV2:
+		return []func(*s3.Options){func(o *s3.Options) {
+			o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+			// canonicalized resource is computed from request path
+			o.UsePathStyle = true
+			o.HTTPSignerV4 = &sigV2Signer{}
+		}}
+	}
+	return nil
+}
+
+// disableChunkedPayload - Sends required checksums as headers over signed
+// payloads in place of aws-chunked streaming, checksum middleware only uses
+// trailers on HTTPS requests so it is shown the request as plain HTTP
+func disableChunkedPayload(stack *middleware.Stack) error {
+	if _, ok := stack.Finalize.Get(computeInputChecksumID); !ok {
+		return nil
+	}
+	hide := middleware.FinalizeMiddlewareFunc("HideHTTPSFromChecksum", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		if req, ok := in.Request.(*smithyhttp.Request); ok && req.IsHTTPS() {
+			req.URL.Scheme = "http"
+			ctx = middleware.WithStackValue(ctx, unchunkedScheme{}, true)
+		}
+		return next.HandleFinalize(ctx, in)
+	})
+	restore := middleware.FinalizeMiddlewareFunc("RestoreHTTPSAfterChecksum", func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+		if hidden, _ := middleware.GetStackValue(ctx, unchunkedScheme{}).(bool); hidden {
+			if req, ok := in.Request.(*smithyhttp.Request); ok {
+				req.URL.Scheme = "https"
+			}
+		}
+		return next.HandleFinalize(ctx, in)
+	})
+	if err := stack.Finalize.Insert(hide, computeInputChecksumID, middleware.Before); err != nil {
+		return err
+	}
+	return stack.Finalize.Insert(restore, computeInputChecksumID, middleware.After)
+}
+
+// sigV2Signer - AWS Signature Version 2 signer, plugged in place of SigV4
+// signer of S3 client
+type sigV2Signer struct{}
+
+// SignHTTP - Implements s3.HTTPSignerV4
+func (s *sigV2Signer) SignHTTP(_ context.Context, credentials aws.Credentials, r *http.Request, _ string, _ string, _ string, signingTime time.Time, _ ...func(*v4.SignerOptions)) error {
+	if len(credentials.SessionToken) != 0 {
+		r.Header.Set("X-Amz-Security-Token", credentials.SessionToken)
+	}
+	r.Header.Set("Date", signingTime.UTC().Format(http.TimeFormat))
+
+	mac := hmac.New(sha1.New, []byte(credentials.SecretAccessKey))
+	mac.Write([]byte(sigV2StringToSign(r)))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	r.Header.Set("Authorization", "AWS "+credentials.AccessKeyID+":"+signature)
+	return nil
+}
+
+func sigV2StringToSign(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method + "\n")
+	b.WriteString(r.Header.Get("Content-Md5") + "\n")
+	b.WriteString(r.Header.Get("Content-Type") + "\n")
+	b.WriteString(r.Header.Get("Date") + "\n")
+
+	var amzHeaders []string
+	for name := range r.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			amzHeaders = append(amzHeaders, lower)
+		}
+	}
+	slices.Sort(amzHeaders)
+	for _, name := range amzHeaders {
+		values := r.Header.Values(name)
+		for i := range values {
+			values[i] = strings.TrimSpace(values[i])
+		}
+		b.WriteString(name + ":" + strings.Join(values, ",") + "\n")
+	}
+
+	b.WriteString(r.URL.EscapedPath())
+	query := r.URL.Query()
+	sep := "?"
+	for _, name := range sigV2SubResources {
+		if !query.Has(name) {
+			continue
+		}
+		b.WriteString(sep + name)
+		if value := query.Get(name); len(value) != 0 {
+			b.WriteString("=" + value)
+		}
+		sep = "&"
+	}
+	return b.String()
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"cmp"
+	"html/template"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/version"
+	log "github.com/sirupsen/logrus"
+)
+
+// stallGrace - Delay on top of two probe intervals after which the probe loop
+// of a target is considered stalled
+const stallGrace = time.Minute
+
+// probeResult - Outcome of last probe of an operation through a route
+type probeResult struct {
+	Operation string
+	Route     route
+	Time      time.Time
+	Duration  time.Duration
+	Err       error
+}
+
+type probeKey struct {
+	operation string
+	route     route
+}
+
+// probeStatus - Progress of probe loop of a target
+type probeStatus struct {
+	mu        sync.Mutex
+	started   time.Time
+	lastCycle time.Time
+	results   map[probeKey]probeResult
+}
+
+func (m *Manager) recordResult(operation string, r route, duration time.Duration, err error) {
+	m.status.mu.Lock()
+	defer m.status.mu.Unlock()
+	if m.status.results == nil {
+		m.status.results = map[probeKey]probeResult{}
+	}
+	m.status.results[probeKey{operation, r}] = probeResult{
+		Operation: operation,
+		Route:     r,
+		Time:      time.Now(),
+		Duration:  duration,
+		Err:       err,
+	}
+}
+
+// dropResults - Forgets results of a route no longer probed
+func (m *Manager) dropResults(r route) {
+	m.status.mu.Lock()
+	defer m.status.mu.Unlock()
+	for k := range m.status.results {
+		if k.route == r {
+			delete(m.status.results, k)
+		}
+	}
+}
+
+// endCycle - Marks completion of a probe cycle
+func (m *Manager) endCycle() {
+	m.status.mu.Lock()
+	defer m.status.mu.Unlock()
+	m.status.lastCycle = time.Now()
+}
+
+// Results - Last probe results, sorted by operation and route
+func (m *Manager) Results() []probeResult {
+	m.status.mu.Lock()
+	defer m.status.mu.Unlock()
+	res := make([]probeResult, 0, len(m.status.results))
+	for _, r := range m.status.results {
+		res = append(res, r)
+	}
+	slices.SortFunc(res, func(a, b probeResult) int {
+		return cmp.Or(
+			cmp.Compare(a.Operation, b.Operation),
+			cmp.Compare(a.Route.Backend, b.Route.Backend),
+			cmp.Compare(a.Route.Connection, b.Route.Connection),
+		)
+	})
+	return res
+}
+
+// Ready - First probe cycle is finished
+func (m *Manager) Ready() bool {
+	m.status.mu.Lock()
+	defer m.status.mu.Unlock()
+	return !m.status.lastCycle.IsZero()
+}
+
+// Stalled - No probe cycle finished within two intervals
+func (m *Manager) Stalled() bool {
+	m.status.mu.Lock()
+	defer m.status.mu.Unlock()
+	last := m.status.lastCycle
+	if last.IsZero() {
+		last = m.status.started
+	}
+	return time.Since(last) > 2*m.config.Exporter.IntervalDuration+stallGrace
+}
+
+// healthyHandler - Reports process alive and no stalled probe loop
+func healthyHandler(managers func() []*Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		for _, m := range managers() {
+			if m.Stalled() {
+				http.Error(w, "probe loop of target '"+m.target.Name+"' is stalled", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("Healthy.\n"))
+	})
+}
+
+// readyHandler - Reports first probe cycle finished on all targets
+func readyHandler(managers func() []*Manager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		for _, m := range managers() {
+			if !m.Ready() {
+				http.Error(w, "first probe cycle of target '"+m.target.Name+"' not finished", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("Ready.\n"))
+	})
+}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>S3 RW Exporter</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+.ok { color: #080; }
+.failed { color: #b00; }
+</style>
+</head>
+<body>
+<h1>S3 RW Exporter</h1>
+<ul>
+<li><a href="{{.MetricsPath}}">Metrics</a></li>
+<li><a href="/-/healthy">Health</a></li>
+<li><a href="/-/ready">Readiness</a></li>
+{{if .Reload}}<li><form action="/-/reload" method="post"><button type="submit">Reload configuration</button></form></li>{{end}}
+</ul>
+<h2>Targets</h2>
+{{range .Targets}}
+<h3>{{.Name}}</h3>
+<p>Bucket <code>{{.Bucket}}</code>{{if .URL}} on <code>{{.URL}}</code>{{end}}</p>
+{{if .Results}}
+<table>
+<tr><th>Operation</th><th>Backend</th><th>Connection</th><th>Status</th><th>Duration</th><th>Time</th><th>Error</th></tr>
+{{range .Results}}
+<tr>
+<td>{{.Operation}}</td>
+<td>{{or .Route.Backend "-"}}</td>
+<td>{{.Route.Connection}}</td>
+{{if .Err}}<td class="failed">failed</td>{{else}}<td class="ok">ok</td>{{end}}
+<td>{{if not .Err}}{{.Duration}}{{end}}</td>
+<td>{{.Time.Format "2006-01-02T15:04:05Z07:00"}}</td>
+<td>{{if .Err}}{{.Err}}{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p>No probe finished yet.</p>
+{{end}}
+{{end}}
+<h2>Build</h2>
+<pre>{{.Version}}</pre>
+</body>
+</html>
+`))
+
+// landingHandler - Renders HTML page listing targets and their last probe
+// results, reload button is shown when reload endpoint is served
+func landingHandler(metricsPath string, reload bool, managers func() []*Manager) http.Handler {
+	type target struct {
+		Name    string
+		Bucket  string
+		URL     string
+		Results []probeResult
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		data := struct {
+			MetricsPath string
+			Reload      bool
+			Targets     []target
+			Version     string
+		}{
+			MetricsPath: metricsPath,
+			Reload:      reload,
+			Version:     version.Print("s3rw"),
+		}
+		for _, m := range managers() {
+			data.Targets = append(data.Targets, target{
+				Name:    m.target.Name,
+				Bucket:  m.target.Bucket,
+				URL:     m.target.URL,
+				Results: m.Results(),
+			})
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := landingTemplate.Execute(w, data); err != nil {
+			log.Errorf("unable to render landing page: %s", err)
+		}
+	})
+}
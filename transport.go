@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type tlsConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	MinVersion         string `yaml:"min_version"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+func (c *tlsConfig) validate(path string, errs *configErrors) {
+	if len(c.CertFile) != 0 && len(c.KeyFile) == 0 {
+		errs.add(path+".key_file", "missing key, mandatory with cert_file")
+	}
+	if len(c.KeyFile) != 0 && len(c.CertFile) == 0 {
+		errs.add(path+".cert_file", "missing key, mandatory with key_file")
+	}
+	if _, ok := tlsVersions[c.MinVersion]; len(c.MinVersion) != 0 && !ok {
+		errs.add(path+".min_version", "invalid value '%s', must be one of 1.0, 1.1, 1.2, 1.3", c.MinVersion)
+	}
+}
+
+type resolverConfig struct {
+	Address string        `yaml:"address"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *resolverConfig) validate(path string, errs *configErrors) {
+	if len(c.Address) == 0 {
+		return
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		errs.add(path+".address", "invalid value '%s': %s", c.Address, err)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Second
+	}
+}
+
+// build - Creates resolver querying configured DNS server, nil when system
+// resolver must be used
+func (c *resolverConfig) build() *net.Resolver {
+	if len(c.Address) == 0 {
+		return nil
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: c.Timeout}
+			conn, err := d.DialContext(ctx, network, c.Address)
+			if err != nil {
+				return nil, err
+			}
+			return conn, conn.SetDeadline(time.Now().Add(c.Timeout))
+		},
+	}
+}
+
+// build - Creates TLS client configuration from referenced files
+func (c *tlsConfig) build() (*tls.Config, error) {
+	res := &tls.Config{
+		ServerName:         c.ServerName,
+		MinVersion:         tlsVersions[c.MinVersion],
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if len(c.CAFile) != 0 {
+		content, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca file '%s': %s", c.CAFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in ca file '%s'", c.CAFile)
+		}
+		res.RootCAs = pool
+	}
+	if len(c.CertFile) != 0 {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+	return res, nil
+}
+
+// newHTTPClient - HTTP client used by S3 clients of the target, connecting
+// through given route
+func (m *Manager) newHTTPClient(r route) (*awshttp.BuildableClient, error) {
+	tlsCfg, err := m.target.TLS.build()
+	if err != nil {
+		return nil, err
+	}
+	var proxyURL *url.URL
+	if len(m.target.ProxyURL) != 0 {
+		value, err := m.target.ProxyURL.resolve()
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL, err = url.Parse(value); err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %s", err)
+		}
+	}
+
+	// backend of route only replaces the address of the S3 endpoint, other
+	// hosts such as STS are dialed as is
+	var endpoint string
+	if host, port, err := m.endpoint(); err == nil {
+		endpoint = net.JoinHostPort(host, port)
+	}
+
+	return awshttp.NewBuildableClient().WithDialerOptions(func(d *net.Dialer) {
+		if len(m.target.SourceAddress) != 0 {
+			d.LocalAddr = &net.TCPAddr{IP: net.ParseIP(m.target.SourceAddress)}
+		}
+		if resolver := m.target.Resolver.build(); resolver != nil {
+			d.Resolver = resolver
+		}
+	}).WithTransportOptions(func(tr *http.Transport) {
+		if proxyURL != nil {
+			tr.Proxy = http.ProxyURL(proxyURL)
+		}
+		if r.Connection == connectionCold {
+			tr.DisableKeepAlives = true
+		}
+		// keep host name for Host header and SNI, only dialed address changes
+		dial := tr.DialContext
+		tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			addrs := m.target.Resolve[net.JoinHostPort(host, port)]
+			if len(r.Backend) != 0 && net.JoinHostPort(host, port) == endpoint {
+				addrs = []string{r.Backend}
+			}
+			if len(addrs) == 0 {
+				return dial(ctx, network, addr)
+			}
+			for _, a := range addrs {
+				var conn net.Conn
+				if conn, err = dial(ctx, network, net.JoinHostPort(a, port)); err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		}
+		// keep SDK defaults unless overridden
+		if tr.TLSClientConfig != nil {
+			if tlsCfg.MinVersion == 0 {
+				tlsCfg.MinVersion = tr.TLSClientConfig.MinVersion
+			}
+			tlsCfg.CurvePreferences = tr.TLSClientConfig.CurvePreferences
+		}
+		// proxy handshakes and other hosts must not be reported as endpoint
+		tlsCfg.VerifyConnection = func(state tls.ConnectionState) error {
+			if m.endpointName(state.ServerName) {
+				m.tlsMu.Lock()
+				m.tlsStates[r.Backend] = &state
+				m.tlsMu.Unlock()
+			}
+			return nil
+		}
+		tr.TLSClientConfig = tlsCfg
+	}), nil
+}
+
+// awsEndpointPattern - Matches host names of AWS S3 endpoints
+var awsEndpointPattern = regexp.MustCompile(`(^|\.)s3[.-]`)
+
+// endpointName - Server name of TLS handshake is the one of S3 endpoint
+func (m *Manager) endpointName(name string) bool {
+	if len(m.target.TLS.ServerName) != 0 {
+		return name == m.target.TLS.ServerName
+	}
+	host, _, err := m.endpoint()
+	if err != nil {
+		// AWS endpoint, host depends on region, addressing style and options
+		return awsEndpointPattern.MatchString(name)
+	}
+	return name == host
+}
+
+// TLSStates - Connection state of the last TLS handshake with the S3 endpoint
+// per backend address, empty address stands for regular name resolution
+func (m *Manager) TLSStates() map[string]*tls.ConnectionState {
+	m.tlsMu.Lock()
+	defer m.tlsMu.Unlock()
+	return maps.Clone(m.tlsStates)
+}
+
+// dropTLSStates - Forgets handshakes with backends no longer probed
+func (m *Manager) dropTLSStates(backends []string) {
+	m.tlsMu.Lock()
+	defer m.tlsMu.Unlock()
+	maps.DeleteFunc(m.tlsStates, func(b string, _ *tls.ConnectionState) bool {
+		return !slices.Contains(backends, b)
+	})
+}
+
+// traceContext - Logs addresses resolved and connected to during given probe
+func (m *Manager) traceContext(ctx context.Context, probe string, r route) context.Context {
+	entry := m.entry.WithField("probe", probe)
+	if len(r.Backend) != 0 {
+		entry = entry.WithField("backend_ip", r.Backend)
+	}
+	if len(r.Connection) != 0 {
+		entry = entry.WithField("connection", r.Connection)
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err != nil {
+				entry.Errorf("unable to resolve endpoint: %s", info.Err)
+				return
+			}
+			addrs := make([]string, 0, len(info.Addrs))
+			for _, a := range info.Addrs {
+				addrs = append(addrs, a.String())
+			}
+			entry.Infof("resolved endpoint to %s", strings.Join(addrs, ", "))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err == nil {
+				entry.Debugf("connected to %s", addr)
+			}
+		},
+	})
+}
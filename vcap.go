@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type vcapConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Services restricts bindings to given service labels or instance names
+	Services []string `yaml:"services"`
+	// Defaults holds settings of generated targets not provided by bindings
+	Defaults s3Config      `yaml:"defaults"`
+	Mappings []vcapMapping `yaml:"mappings"`
+}
+
+// vcapMapping - Names of binding credentials fields, nested fields are
+// separated by dots
+type vcapMapping struct {
+	URL             string `yaml:"url"`
+	Region          string `yaml:"region"`
+	Bucket          string `yaml:"bucket"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+}
+
+// vcapDefaultMappings - Layouts of commonly used S3 service brokers
+var vcapDefaultMappings = []vcapMapping{
+	// aws service broker, cloud.gov
+	{URL: "endpoint", Region: "region", Bucket: "bucket", AccessKeyID: "access_key_id", SecretAccessKey: "secret_access_key"},
+	// dell ecs service broker
+	{URL: "endpoint", Region: "region", Bucket: "bucket", AccessKeyID: "accessKey", SecretAccessKey: "secretKey"},
+	// minio and generic s3 brokers
+	{URL: "endpoint", Region: "region", Bucket: "bucket_name", AccessKeyID: "access_key", SecretAccessKey: "secret_key"},
+	{URL: "host", Region: "region", Bucket: "bucket", AccessKeyID: "access_key", SecretAccessKey: "secret_key"},
+}
+
+type vcapService struct {
+	Name        string         `json:"name"`
+	Label       string         `json:"label"`
+	Credentials map[string]any `json:"credentials"`
+}
+
+// targets - Builds one target per bound S3-compatible service instance
+func (c *vcapConfig) targets() ([]s3Config, error) {
+	content := os.Getenv("VCAP_SERVICES")
+	if len(content) == 0 {
+		return nil, nil
+	}
+	services := map[string][]vcapService{}
+	if err := json.Unmarshal([]byte(content), &services); err != nil {
+		return nil, fmt.Errorf("unable to parse VCAP_SERVICES: %s", err)
+	}
+
+	mappings := append(slices.Clone(c.Mappings), vcapDefaultMappings...)
+	res := []s3Config{}
+	for label, instances := range services {
+		for _, instance := range instances {
+			if len(c.Services) != 0 && !slices.Contains(c.Services, label) && !slices.Contains(c.Services, instance.Name) {
+				continue
+			}
+			target, ok := c.target(instance, mappings)
+			if !ok {
+				log.Debugf("ignoring service instance '%s' without S3 credentials", instance.Name)
+				continue
+			}
+			res = append(res, target)
+		}
+	}
+	slices.SortFunc(res, func(a, b s3Config) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return res, nil
+}
+
+// target - Builds target from the first mapping matching service credentials
+func (c *vcapConfig) target(instance vcapService, mappings []vcapMapping) (s3Config, bool) {
+	for _, m := range mappings {
+		bucket := vcapField(instance.Credentials, m.Bucket)
+		accessKeyID := vcapField(instance.Credentials, m.AccessKeyID)
+		secretAccessKey := vcapField(instance.Credentials, m.SecretAccessKey)
+		if len(bucket) == 0 || len(accessKeyID) == 0 || len(secretAccessKey) == 0 {
+			continue
+		}
+
+		target := c.Defaults.clone()
+		target.Name = instance.Name
+		target.Bucket = bucket
+		// binding values are used literally, broker data must not run
+		// commands or read local files
+		target.APIKey = literalSecret(accessKeyID)
+		target.APISecret = literalSecret(secretAccessKey)
+		if url := vcapField(instance.Credentials, m.URL); len(url) != 0 {
+			if !strings.Contains(url, "://") {
+				url = "https://" + url
+			}
+			target.URL = url
+		}
+		if region := vcapField(instance.Credentials, m.Region); len(region) != 0 {
+			target.Region = region
+		}
+		return target, true
+	}
+	return s3Config{}, false
+}
+
+// clone - Copy of target sharing no slice, map or pointer with it
+func (c s3Config) clone() s3Config {
+	res := c
+	res.Connections = slices.Clone(c.Connections)
+	res.Exposure.Buckets = slices.Clone(c.Exposure.Buckets)
+	if c.Resolve != nil {
+		res.Resolve = make(map[string][]string, len(c.Resolve))
+		for k, v := range c.Resolve {
+			res.Resolve[k] = slices.Clone(v)
+		}
+	}
+	if c.BucketSettings.Versioning != nil {
+		versioning := *c.BucketSettings.Versioning
+		res.BucketSettings.Versioning = &versioning
+	}
+	return res
+}
+
+// vcapField - Reads string value at dotted path in binding credentials
+func vcapField(credentials map[string]any, path string) string {
+	if len(path) == 0 {
+		return ""
+	}
+	var value any = credentials
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]any)
+		if !ok {
+			return ""
+		}
+		value = m[key]
+	}
+	if s, ok := value.(string); ok {
+		return s
+	}
+	return ""
+}
+
+// merge - Completes explicitly configured target with values from binding
+func (c *s3Config) merge(binding s3Config) {
+	if len(c.URL) == 0 {
+		c.URL = binding.URL
+	}
+	if len(c.Region) == 0 {
+		c.Region = binding.Region
+	}
+	if len(c.Bucket) == 0 {
+		c.Bucket = binding.Bucket
+	}
+	if len(c.DownloadKey) == 0 {
+		c.DownloadKey = binding.DownloadKey
+	}
+	if len(c.DownloadFilePath) == 0 {
+		c.DownloadFilePath = binding.DownloadFilePath
+	}
+	if len(c.UploadKey) == 0 {
+		c.UploadKey = binding.UploadKey
+	}
+	if len(c.UploadFilePath) == 0 {
+		c.UploadFilePath = binding.UploadFilePath
+	}
+	if len(c.APIKey) == 0 && len(c.Credentials.Type) == 0 {
+		c.APIKey = binding.APIKey
+		c.APISecret = binding.APISecret
+	}
+}